@@ -0,0 +1,54 @@
+package gasp
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"time"
+	"tonysoft.com/gasp/resources"
+)
+
+const (
+	assetsPath = "/gasp/"
+)
+
+type asset struct {
+	path        string
+	contentType string
+	content     []byte
+	etag        string
+}
+
+var (
+	scriptAsset = newAsset("gasp", ".js", "text/javascript; charset=utf-8", resources.GaspScript)
+	styleAsset  = newAsset("gasp", ".css", "text/css; charset=utf-8", resources.GaspStyle)
+)
+
+func newAsset(name string, extension string, contentType string, content string) *asset {
+	hash := sha256.Sum256([]byte(content))
+	fingerprint := hex.EncodeToString(hash[:])[:16]
+
+	return &asset{
+		path:        assetsPath + name + "." + fingerprint + extension,
+		contentType: contentType,
+		content:     []byte(content),
+		etag:        "\"" + fingerprint + "\"",
+	}
+}
+
+func (a *asset) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Content-Type", a.contentType)
+	rw.Header().Set("ETag", a.etag)
+	rw.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	http.ServeContent(rw, req, a.path, time.Time{}, bytes.NewReader(a.content))
+}
+
+func (server *Server) addAssetHandlers() {
+	for _, a := range []*asset{scriptAsset, styleAsset} {
+		if !server.routes.has(a.path) {
+			pattern, _ := parseRoutePattern(a.path)
+			_ = server.routes.add(&routeEntry{pattern: pattern, handler: a, internal: true})
+		}
+	}
+}
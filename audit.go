@@ -0,0 +1,203 @@
+package gasp
+
+import (
+	"encoding/json"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultAuditMemoryCapacity = 1000
+	redactedValue              = "[REDACTED]"
+)
+
+// AuditOptions enables the audit log when a Sink is set.  Every event that's
+// dispatched to the handlers is recorded, along with the state of the controls
+// matching StateFields (control ID patterns, see EventRoute).  The values of the
+// controls matching Redact, and of password textboxes in a Form, are redacted.
+type AuditOptions struct {
+	Sink        AuditSink
+	StateFields []string
+	Redact      []string
+}
+
+type AuditEntry struct {
+	Timestamp  time.Time         `json:"timestamp"`
+	ClientId   string            `json:"client_id"`
+	RemoteAddr string            `json:"remote_addr,omitempty"`
+	Principal  string            `json:"principal,omitempty"`
+	View       string            `json:"view"`
+	Element    string            `json:"element"`
+	Type       string            `json:"type"`
+	State      map[string]string `json:"state,omitempty"`
+}
+
+type AuditSink interface {
+	Record(entry *AuditEntry) error
+}
+
+// AuditFileSink appends entries to a file as JSON lines.
+type AuditFileSink struct {
+	mutex sync.Mutex
+	file  *os.File
+}
+
+// AuditMemorySink keeps the most recent entries in memory, up to its capacity.
+type AuditMemorySink struct {
+	mutex    sync.RWMutex
+	capacity int
+	entries  []AuditEntry
+}
+
+type auditConfig struct {
+	stateFields []*eventPattern
+	redactions  []*eventPattern
+}
+
+func NewAuditFileSink(path string) (*AuditFileSink, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &AuditFileSink{file: file}, nil
+}
+
+func (sink *AuditFileSink) Record(entry *AuditEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+	_, err = sink.file.Write(append(line, '\n'))
+	return err
+}
+
+func (sink *AuditFileSink) Close() error {
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+	return sink.file.Close()
+}
+
+// NewAuditMemorySink keeps up to capacity entries (1000 if not positive).
+func NewAuditMemorySink(capacity int) *AuditMemorySink {
+	if capacity <= 0 {
+		capacity = defaultAuditMemoryCapacity
+	}
+	return &AuditMemorySink{capacity: capacity}
+}
+
+func (sink *AuditMemorySink) Record(entry *AuditEntry) error {
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+
+	if len(sink.entries) == sink.capacity {
+		sink.entries = sink.entries[1:]
+	}
+	sink.entries = append(sink.entries, *entry)
+	return nil
+}
+
+func (sink *AuditMemorySink) Entries() []AuditEntry {
+	sink.mutex.RLock()
+	defer sink.mutex.RUnlock()
+	return append([]AuditEntry(nil), sink.entries...)
+}
+
+func (server *Server) initAudit() error {
+	for _, field := range server.options.Audit.StateFields {
+		pattern, err := newEventPattern(field)
+		if err != nil {
+			return err
+		}
+		server.audit.stateFields = append(server.audit.stateFields, pattern)
+	}
+
+	for _, field := range server.options.Audit.Redact {
+		err := server.redactAuditField(field)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (server *Server) redactAuditField(id string) error {
+	pattern, err := newEventPattern(id)
+	if err != nil {
+		return err
+	}
+	server.audit.redactions = append(server.audit.redactions, pattern)
+	return nil
+}
+
+func (server *Server) recordEvent(c *client, event *ClientEvent) {
+	sink := server.options.Audit.Sink
+	if sink == nil {
+		return
+	}
+
+	entry := AuditEntry{
+		Timestamp:  time.Now().UTC(),
+		ClientId:   c.id,
+		RemoteAddr: c.request.RemoteAddr,
+		View:       event.View,
+		Element:    event.Id,
+		Type:       event.Type,
+	}
+
+	if event.Principal != nil {
+		entry.Principal = event.Principal.Name
+	}
+
+	for id, value := range getStateValues(&event.State) {
+		if !matchesAnyPattern(server.audit.stateFields, id) {
+			continue
+		}
+		if matchesAnyPattern(server.audit.redactions, id) {
+			value = redactedValue
+		}
+		if entry.State == nil {
+			entry.State = make(map[string]string)
+		}
+		entry.State[id] = value
+	}
+
+	err := sink.Record(&entry)
+	if err != nil {
+		server.sendClientError(ErrorSourceAudit, c.id, err)
+	}
+}
+
+func getStateValues(state *FormState) map[string]string {
+	values := make(map[string]string)
+	for _, s := range state.Textboxes {
+		values[s.Id] = s.Text
+	}
+	for _, s := range state.Buttons {
+		values[s.Id] = s.Text
+	}
+	for _, s := range state.Labels {
+		values[s.Id] = s.Text
+	}
+	for _, s := range state.Dropdowns {
+		values[s.Id] = s.Text
+	}
+	for _, s := range state.Checkboxes {
+		values[s.Id] = strconv.FormatBool(s.IsChecked)
+	}
+	return values
+}
+
+func matchesAnyPattern(patterns []*eventPattern, value string) bool {
+	for _, pattern := range patterns {
+		if pattern.matches(value) {
+			return true
+		}
+	}
+	return false
+}
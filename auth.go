@@ -0,0 +1,283 @@
+package gasp
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	authorizeVariablePrefix = "gasp_authorize:"
+	authorizeHide           = "hide"
+	authorizeDisable        = "disable"
+)
+
+// AuthOptions enables authentication when an Authenticator is set.  Requests for
+// the PublicPaths (route patterns, such as "login" or "public/") and Gasp's assets
+// don't require it.  Unauthenticated requests are redirected to the LoginPath, if
+// set, and otherwise receive a 401 Unauthorized.
+type AuthOptions struct {
+	Authenticator Authenticator
+	PublicPaths   []string
+	LoginPath     string
+}
+
+type Principal struct {
+	Name  string
+	Roles []string
+}
+
+// Authenticator returns the principal a request was made by, or nil if the request
+// isn't authenticated.
+type Authenticator interface {
+	Authenticate(req *http.Request) (*Principal, error)
+}
+
+// Challenger is implemented by authenticators that ask clients for credentials
+// with a WWW-Authenticate header.
+type Challenger interface {
+	Challenge() string
+}
+
+type AuthenticatorFunc func(req *http.Request) (*Principal, error)
+
+type principalKey struct{}
+
+type basicAuthenticator struct {
+	realm string
+	check func(username string, password string) *Principal
+}
+
+type bearerAuthenticator struct {
+	tokens map[[sha256.Size]byte]*Principal
+}
+
+type anyAuthenticator []Authenticator
+
+type eventAuthorization struct {
+	view  *eventPattern
+	id    *eventPattern
+	roles []string
+}
+
+func (f AuthenticatorFunc) Authenticate(req *http.Request) (*Principal, error) {
+	return f(req)
+}
+
+func (principal *Principal) HasRole(role string) bool {
+	if principal == nil {
+		return false
+	}
+	for _, r := range principal.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// BasicAuth authenticates the users with HTTP basic auth, using the user names as
+// the principal names.
+func BasicAuth(realm string, users map[string]string) Authenticator {
+	hashes := make(map[string][sha256.Size]byte, len(users))
+	for username, password := range users {
+		hashes[username] = sha256.Sum256([]byte(password))
+	}
+
+	return BasicAuthFunc(realm, func(username string, password string) *Principal {
+		expected, ok := hashes[username]
+		hash := sha256.Sum256([]byte(password))
+		valid := subtle.ConstantTimeCompare(expected[:], hash[:]) == 1
+		if !ok || !valid {
+			return nil
+		}
+		return &Principal{Name: username}
+	})
+}
+
+// BasicAuthFunc authenticates with HTTP basic auth, calling check with the
+// credentials to get the principal, or nil if they're invalid.
+func BasicAuthFunc(realm string, check func(username string, password string) *Principal) Authenticator {
+	return &basicAuthenticator{realm: realm, check: check}
+}
+
+func (auth *basicAuthenticator) Authenticate(req *http.Request) (*Principal, error) {
+	username, password, ok := req.BasicAuth()
+	if !ok {
+		return nil, nil
+	}
+	return auth.check(username, password), nil
+}
+
+func (auth *basicAuthenticator) Challenge() string {
+	return fmt.Sprintf(`Basic realm="%s", charset="UTF-8"`, strings.ReplaceAll(auth.realm, `"`, `'`))
+}
+
+// BearerTokens authenticates requests with an "Authorization: Bearer <token>"
+// header for one of the tokens.
+func BearerTokens(tokens map[string]*Principal) Authenticator {
+	auth := bearerAuthenticator{tokens: make(map[[sha256.Size]byte]*Principal, len(tokens))}
+	for token, principal := range tokens {
+		auth.tokens[sha256.Sum256([]byte(token))] = principal
+	}
+	return &auth
+}
+
+func (auth *bearerAuthenticator) Authenticate(req *http.Request) (*Principal, error) {
+	scheme, token, ok := strings.Cut(req.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return nil, nil
+	}
+	return auth.tokens[sha256.Sum256([]byte(strings.TrimSpace(token)))], nil
+}
+
+func (auth *bearerAuthenticator) Challenge() string {
+	return "Bearer"
+}
+
+// AnyAuthenticator returns the principal from the first authenticator that
+// authenticates the request.
+func AnyAuthenticator(authenticators ...Authenticator) Authenticator {
+	return anyAuthenticator(authenticators)
+}
+
+func (auths anyAuthenticator) Authenticate(req *http.Request) (*Principal, error) {
+	for _, auth := range auths {
+		principal, err := auth.Authenticate(req)
+		if principal != nil || err != nil {
+			return principal, err
+		}
+	}
+	return nil, nil
+}
+
+func (auths anyAuthenticator) Challenge() string {
+	for _, auth := range auths {
+		if challenger, ok := auth.(Challenger); ok {
+			return challenger.Challenge()
+		}
+	}
+	return ""
+}
+
+func GetPrincipal(req *http.Request) *Principal {
+	principal, _ := req.Context().Value(principalKey{}).(*Principal)
+	return principal
+}
+
+func (server *Server) initAuth() error {
+	options := server.options.Auth
+	if options.Authenticator == nil {
+		return nil
+	}
+
+	publicPaths := append([]string{assetsPath}, options.PublicPaths...)
+	if options.LoginPath != "" {
+		publicPaths = append(publicPaths, options.LoginPath)
+	}
+
+	for _, path := range publicPaths {
+		if !strings.HasPrefix(path, "/") {
+			path = "/" + path
+		}
+		pattern, err := parseRoutePattern(path)
+		if err != nil {
+			return fmt.Errorf("invalid public path '%s': %v", path, err)
+		}
+		server.publicPaths = append(server.publicPaths, pattern)
+	}
+
+	return nil
+}
+
+// authenticate returns the request with the principal it was made by, or false if
+// the request isn't authenticated and has been answered.
+func (server *Server) authenticate(rw http.ResponseWriter, req *http.Request) (*http.Request, bool) {
+	options := server.options.Auth
+	if options.Authenticator == nil {
+		return req, true
+	}
+
+	principal, err := options.Authenticator.Authenticate(req)
+	if err != nil {
+		server.sendError(ErrorSourceAuth, err)
+	}
+
+	if principal != nil {
+		return req.WithContext(context.WithValue(req.Context(), principalKey{}, principal)), true
+	}
+
+	for _, pattern := range server.publicPaths {
+		if _, ok := pattern.match(req.URL.Path); ok && pattern.allowsMethod(req.Method) {
+			return req, true
+		}
+	}
+
+	if options.LoginPath != "" && req.Method == http.MethodGet && req.URL.Path != websocketsPath {
+		RedirectRequest(options.LoginPath+"?next="+url.QueryEscape(req.URL.RequestURI())).apply(rw, req)
+		return req, false
+	}
+
+	if challenger, ok := options.Authenticator.(Challenger); ok && challenger.Challenge() != "" {
+		rw.Header().Set("WWW-Authenticate", challenger.Challenge())
+	}
+	http.Error(rw, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+	return req, false
+}
+
+// AuthorizeEvents rejects the events from the elements matching the view and id
+// patterns (see EventRoute) unless the client's principal has one of the roles.
+func (server *Server) AuthorizeEvents(view string, id string, roles ...string) error {
+	if len(roles) == 0 {
+		return errors.New("at least one role is required")
+	}
+
+	viewPattern, err := newEventPattern(view)
+	if err != nil {
+		return err
+	}
+
+	idPattern, err := newEventPattern(id)
+	if err != nil {
+		return err
+	}
+
+	server.authorizations = append(server.authorizations, &eventAuthorization{view: viewPattern, id: idPattern, roles: roles})
+	return nil
+}
+
+func (server *Server) isAuthorizedEvent(event *ClientEvent) bool {
+	for _, authorization := range server.authorizations {
+		if authorization.view.matches(event.View) && authorization.id.matches(event.Id) && !hasAnyRole(event.Principal, authorization.roles) {
+			return false
+		}
+	}
+	return true
+}
+
+// renderAuthorization returns the attributes for a control that requires roles,
+// from a variable such as "gasp_authorize:hide:admin,operator".
+func (server *Server) renderAuthorization(variableName string, req *http.Request) string {
+	mode, roles, _ := strings.Cut(strings.TrimPrefix(variableName, authorizeVariablePrefix), ":")
+	if hasAnyRole(GetPrincipal(req), strings.Split(roles, ",")) {
+		return ""
+	}
+	if mode == authorizeDisable {
+		return "disabled "
+	}
+	return "hidden disabled "
+}
+
+func hasAnyRole(principal *Principal, roles []string) bool {
+	for _, role := range roles {
+		if principal.HasRole(role) {
+			return true
+		}
+	}
+	return false
+}
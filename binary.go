@@ -0,0 +1,152 @@
+package gasp
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+)
+
+type MessageFormat int
+
+const (
+	MessageFormatJSON MessageFormat = iota
+	MessageFormatBinary
+)
+
+const (
+	binaryMessageVersion   = 1
+	attachmentKindBytes    = "u8"
+	attachmentKindFloat64s = "f64"
+)
+
+// Binary messages consist of a version byte, the length of the JSON header as a
+// big-endian uint32, the header itself and then the attachments' raw data.  The
+// header holds the event(s) with their byte and float arrays removed, along with
+// the path to where each attachment belongs.  Floats are little-endian.
+type binaryHeader struct {
+	Payload     interface{}         `json:"payload"`
+	Attachments []*binaryAttachment `json:"attachments"`
+}
+
+type binaryAttachment struct {
+	Path   []interface{} `json:"path"`
+	Kind   string        `json:"kind"`
+	Length int           `json:"length"`
+	data   []byte
+}
+
+func encodeBinaryMessage(events []*ServerEvent, batched bool) ([]byte, error) {
+	attachments := make([]*binaryAttachment, 0)
+	extracted := make([]*ServerEvent, len(events))
+	for i, event := range events {
+		var path []interface{}
+		if batched {
+			path = []interface{}{i}
+		}
+		extracted[i] = extractAttachments(event, path, &attachments)
+	}
+
+	header := binaryHeader{Attachments: attachments}
+	if batched {
+		header.Payload = extracted
+	} else {
+		header.Payload = extracted[0]
+	}
+
+	headerBytes, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+
+	buffer := bytes.Buffer{}
+	buffer.WriteByte(binaryMessageVersion)
+	err = binary.Write(&buffer, binary.BigEndian, uint32(len(headerBytes)))
+	if err != nil {
+		return nil, err
+	}
+	buffer.Write(headerBytes)
+	for _, attachment := range attachments {
+		buffer.Write(attachment.data)
+	}
+
+	return buffer.Bytes(), nil
+}
+
+func extractAttachments(event *ServerEvent, path []interface{}, attachments *[]*binaryAttachment) *ServerEvent {
+	if event.Data == nil {
+		return event
+	}
+
+	statePath := append(append([]interface{}{}, path...), "data", "state")
+
+	var state interface{}
+	switch s := event.Data["state"].(type) {
+	case *PacketInspectorState:
+		packet := s.packetBytes()
+		if len(packet) == 0 {
+			return event
+		}
+
+		stateCopy := *s
+		stateCopy.Packet = ""
+		stateCopy.packet = nil
+		state = &stateCopy
+
+		*attachments = append(*attachments, &binaryAttachment{
+			Path:   append(statePath, "packet"),
+			Kind:   attachmentKindBytes,
+			Length: len(packet),
+			data:   packet,
+		})
+	case *LineChartState:
+		stateCopy := *s
+		stateCopy.Lines = make([]*LineState, len(s.Lines))
+		for i, line := range s.Lines {
+			lineCopy := *line
+			lineCopy.NewValues = nil
+			stateCopy.Lines[i] = &lineCopy
+
+			if len(line.NewValues) == 0 {
+				continue
+			}
+
+			data := make([]byte, len(line.NewValues)*8)
+			for j, v := range line.NewValues {
+				binary.LittleEndian.PutUint64(data[j*8:], math.Float64bits(v))
+			}
+
+			linePath := append(append([]interface{}{}, statePath...), "lines", i, "new_values")
+			*attachments = append(*attachments, &binaryAttachment{
+				Path:   linePath,
+				Kind:   attachmentKindFloat64s,
+				Length: len(line.NewValues),
+				data:   data,
+			})
+		}
+		state = &stateCopy
+	default:
+		return event
+	}
+
+	eventCopy := *event
+	eventCopy.Data = make(map[string]interface{}, len(event.Data))
+	for k, v := range event.Data {
+		eventCopy.Data[k] = v
+	}
+	eventCopy.Data["state"] = state
+	return &eventCopy
+}
+
+func (state *PacketInspectorState) packetBytes() []byte {
+	if state.packet != nil {
+		return state.packet
+	}
+
+	packet, err := base64.StdEncoding.DecodeString(state.Packet)
+	if err != nil {
+		return nil
+	}
+	return packet
+}
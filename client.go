@@ -0,0 +1,34 @@
+package gasp
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/gorilla/websocket"
+	"net/http"
+)
+
+type client struct {
+	id           string
+	ws           *websocket.Conn
+	queue        *eventQueue
+	request      *http.Request
+	limiter      *rateLimiter
+	typeLimiters map[string]*rateLimiter
+}
+
+func newClient(ws *websocket.Conn, queue *eventQueue, request *http.Request) (*client, error) {
+	idBytes := make([]byte, 16)
+	_, err := rand.Read(idBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	c := client{
+		id:           hex.EncodeToString(idBytes),
+		ws:           ws,
+		queue:        queue,
+		request:      request,
+		typeLimiters: make(map[string]*rateLimiter),
+	}
+	return &c, nil
+}
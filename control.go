@@ -1,7 +1,5 @@
 package gasp
 
-import "encoding/base64"
-
 type FormControl struct {
 	id   string
 	form *Form
@@ -179,7 +177,7 @@ func (control *LineChart) UpdateIsEnabled(isEnabled bool) {
 func (control *PacketInspector) UpdateBytes(packet []byte) {
 	state := PacketInspectorState{}
 	state.Id = control.id
-	state.Packet = base64.StdEncoding.EncodeToString(packet)
+	state.packet = append([]byte(nil), packet...)
 	control.form.UpdatePacketInspector(&state, "packet")
 }
 
@@ -0,0 +1,100 @@
+package gasp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	defaultCsrfTokenMaxAge = 24 * time.Hour
+	csrfTokenParameter     = "csrf_token"
+	csrfNonceSize          = 16
+)
+
+func (server *Server) initCsrf() error {
+	if server.options.CsrfTokenMaxAge <= 0 {
+		server.options.CsrfTokenMaxAge = defaultCsrfTokenMaxAge
+	}
+
+	server.csrfSecret = make([]byte, 32)
+	_, err := rand.Read(server.csrfSecret)
+	return err
+}
+
+// GenerateCsrfToken returns a token for a page served for the request, which the
+// page's script sends when it connects to the WebSockets channel.  It's embedded in
+// the server's views automatically, and only needs to be added to a ViewConfig for
+// views generated separately.  Tokens are bound to the session, if there is one,
+// and expire after ServerOptions.CsrfTokenMaxAge.
+func (server *Server) GenerateCsrfToken(req *http.Request) string {
+	payload := make([]byte, csrfNonceSize+8)
+	_, _ = rand.Read(payload[:csrfNonceSize])
+	binary.BigEndian.PutUint64(payload[csrfNonceSize:], uint64(time.Now().Add(server.options.CsrfTokenMaxAge).Unix()))
+
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + server.signCsrfPayload(encoded, req)
+}
+
+func (server *Server) verifyCsrfToken(token string, req *http.Request) bool {
+	encoded, signature, ok := strings.Cut(token, ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(server.signCsrfPayload(encoded, req))) {
+		return false
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil || len(payload) != csrfNonceSize+8 {
+		return false
+	}
+
+	expires := time.Unix(int64(binary.BigEndian.Uint64(payload[csrfNonceSize:])), 0)
+	return time.Now().Before(expires)
+}
+
+func (server *Server) signCsrfPayload(encoded string, req *http.Request) string {
+	mac := hmac.New(sha256.New, server.csrfSecret)
+	mac.Write([]byte(encoded))
+	if session := GetSession(req); session != nil {
+		mac.Write([]byte(session.id))
+	}
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// checkUpgrade verifies the origin (when the client sends one) and, unless disabled,
+// the CSRF token of a WebSockets upgrade request.
+func (server *Server) checkUpgrade(req *http.Request) error {
+	origin := req.Header.Get("Origin")
+	if origin != "" && !server.isAllowedOrigin(origin, req) {
+		return fmt.Errorf("%w: '%s'", ErrOriginNotAllowed, origin)
+	}
+
+	if !server.options.DisableCsrfToken && !server.verifyCsrfToken(req.URL.Query().Get(csrfTokenParameter), req) {
+		return ErrInvalidCsrfToken
+	}
+
+	return nil
+}
+
+// isAllowedOrigin returns whether the origin is one of ServerOptions.AllowedOrigins
+// ("*" allows any), or if none are set, whether it's the host the request was sent
+// to.
+func (server *Server) isAllowedOrigin(origin string, req *http.Request) bool {
+	if len(server.options.AllowedOrigins) == 0 {
+		originUrl, err := url.Parse(origin)
+		return err == nil && strings.EqualFold(originUrl.Host, req.Host)
+	}
+
+	for _, allowed := range server.options.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return true
+		}
+	}
+	return false
+}
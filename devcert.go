@@ -0,0 +1,267 @@
+package gasp
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	devCaValidity          = 10 * 365 * 24 * time.Hour
+	devCertificateValidity = 397 * 24 * time.Hour
+	devRenewalPeriod       = 30 * 24 * time.Hour
+	devCaName              = "ca"
+)
+
+var (
+	defaultDevHosts = []string{"localhost", "127.0.0.1", "::1"}
+)
+
+// DevCertificate is a server certificate signed by a local development CA.  Clients
+// trust it once the CA (CaFile) is added to their trusted roots.
+type DevCertificate struct {
+	Certificate   tls.Certificate
+	CaCertificate *x509.Certificate
+	CaFile        string
+	CertFile      string
+	KeyFile       string
+}
+
+// GenerateDevCertificate returns a certificate for the hosts (and localhost) signed
+// by a local CA, both of which are cached in the user's cache directory and only
+// created when they're missing or about to expire.
+func GenerateDevCertificate(hosts ...string) (*DevCertificate, error) {
+	dir, err := defaultDevCertificateDir()
+	if err != nil {
+		return nil, err
+	}
+	return GenerateDevCertificateInDir(dir, hosts...)
+}
+
+// GenerateDevCertificateInDir is GenerateDevCertificate with the certificates cached
+// in the directory.
+func GenerateDevCertificateInDir(dir string, hosts ...string) (*DevCertificate, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create certificate directory: %v", err)
+	}
+
+	hosts = getDevHosts(hosts)
+
+	caFile := filepath.Join(dir, devCaName+".crt")
+	caKeyFile := filepath.Join(dir, devCaName+".key")
+	caCert, caKey, err := loadDevCertificate(caFile, caKeyFile)
+	if err != nil || !caCert.IsCA {
+		caCert, caKey, err = createDevCertificate(caFile, caKeyFile, getDevCaTemplate(), nil, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	hash := sha256.Sum256([]byte(strings.Join(hosts, ",")))
+	name := "server-" + hex.EncodeToString(hash[:4])
+	certFile := filepath.Join(dir, name+".crt")
+	keyFile := filepath.Join(dir, name+".key")
+
+	cert, key, err := loadDevCertificate(certFile, keyFile)
+	if err != nil || cert.CheckSignatureFrom(caCert) != nil {
+		cert, key, err = createDevCertificate(certFile, keyFile, getDevServerTemplate(hosts), caCert, caKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &DevCertificate{
+		Certificate: tls.Certificate{
+			Certificate: [][]byte{cert.Raw, caCert.Raw},
+			PrivateKey:  key,
+			Leaf:        cert,
+		},
+		CaCertificate: caCert,
+		CaFile:        caFile,
+		CertFile:      certFile,
+		KeyFile:       keyFile,
+	}, nil
+}
+
+func (cert *DevCertificate) TLSConfig() *tls.Config {
+	return &tls.Config{Certificates: []tls.Certificate{cert.Certificate}}
+}
+
+// CertPool returns a pool with the CA, for clients (such as tests) to trust the
+// certificate.
+func (cert *DevCertificate) CertPool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(cert.CaCertificate)
+	return pool
+}
+
+// StartWithAutoTLS serves TLS with a development certificate for the server's
+// socket (see GenerateDevCertificate), cached in ServerOptions.DevCertificateDir
+// if set.
+func (server *Server) StartWithAutoTLS() error {
+	var hosts []string
+	host, _, err := net.SplitHostPort(server.commSocket)
+	if err == nil && host != "" {
+		hosts = append(hosts, host)
+	}
+
+	var cert *DevCertificate
+	if server.options.DevCertificateDir != "" {
+		cert, err = GenerateDevCertificateInDir(server.options.DevCertificateDir, hosts...)
+	} else {
+		cert, err = GenerateDevCertificate(hosts...)
+	}
+	if err != nil {
+		return err
+	}
+
+	return server.StartWithTLSConfig(cert.TLSConfig())
+}
+
+func defaultDevCertificateDir() (string, error) {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(cacheDir, "gasp", "certs"), nil
+}
+
+func getDevHosts(hosts []string) []string {
+	seen := make(map[string]bool)
+	var result []string
+	for _, host := range append(hosts, defaultDevHosts...) {
+		host = strings.ToLower(strings.Trim(strings.TrimSpace(host), "[]"))
+		if host == "" || seen[host] {
+			continue
+		}
+		if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+			continue
+		}
+		seen[host] = true
+		result = append(result, host)
+	}
+	sort.Strings(result)
+	return result
+}
+
+func getDevCaTemplate() *x509.Certificate {
+	name := "Gasp Development CA"
+	if hostname, err := os.Hostname(); err == nil {
+		name += " (" + hostname + ")"
+	}
+
+	return &x509.Certificate{
+		Subject:               pkix.Name{CommonName: name, Organization: []string{"Gasp"}},
+		NotAfter:              time.Now().Add(devCaValidity),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		MaxPathLenZero:        true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+}
+
+func getDevServerTemplate(hosts []string) *x509.Certificate {
+	template := x509.Certificate{
+		Subject:     pkix.Name{CommonName: hosts[0], Organization: []string{"Gasp"}},
+		NotAfter:    time.Now().Add(devCertificateValidity),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	return &template
+}
+
+// loadDevCertificate returns the cached certificate, or an error if it's missing,
+// invalid or about to expire.
+func loadDevCertificate(certFile string, keyFile string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	key, ok := pair.PrivateKey.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, nil, errors.New("unsupported private key type")
+	}
+
+	if time.Now().Add(devRenewalPeriod).After(cert.NotAfter) {
+		return nil, nil, errors.New("certificate is about to expire")
+	}
+
+	return cert, key, nil
+}
+
+// createDevCertificate creates and saves a certificate from the template, signed
+// by the parent (or self-signed if nil).
+func createDevCertificate(certFile string, keyFile string, template *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	template.SerialNumber = serialNumber
+	template.NotBefore = time.Now().Add(-time.Hour)
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return cert, key, nil
+}
@@ -0,0 +1,84 @@
+package gasp
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"net"
+	"net/http"
+)
+
+type ErrorSource string
+
+const (
+	ErrorSourceListener  ErrorSource = "listener"
+	ErrorSourceView      ErrorSource = "view"
+	ErrorSourceWebsocket ErrorSource = "websocket"
+	ErrorSourceDecode    ErrorSource = "decode"
+	ErrorSourceHandler   ErrorSource = "handler"
+	ErrorSourceResource  ErrorSource = "resource"
+	ErrorSourceSession   ErrorSource = "session"
+	ErrorSourceAuth      ErrorSource = "auth"
+	ErrorSourceAudit     ErrorSource = "audit"
+)
+
+var (
+	ErrOriginNotAllowed = errors.New("origin not allowed")
+	ErrInvalidCsrfToken = errors.New("invalid CSRF token")
+	ErrUnauthorized     = errors.New("unauthorized")
+)
+
+type Error struct {
+	Source   ErrorSource
+	ClientId string
+	Err      error
+}
+
+func (err *Error) Error() string {
+	if err.ClientId != "" {
+		return fmt.Sprintf("%s error (client: '%s'): %v", err.Source, err.ClientId, err.Err)
+	}
+	return fmt.Sprintf("%s error: %v", err.Source, err.Err)
+}
+
+func (err *Error) Unwrap() error {
+	return err.Err
+}
+
+func IsBenignError(err error) bool {
+	return errors.Is(err, http.ErrServerClosed) ||
+		errors.Is(err, net.ErrClosed) ||
+		websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseNoStatusReceived)
+}
+
+type HandlerError struct {
+	View      string
+	ElementId string
+	EventType string
+	ClientId  string
+	Recovered interface{}
+	Stack     []byte
+}
+
+func (err *HandlerError) Error() string {
+	return fmt.Sprintf("handler for event '%s' (view: '%s', element: '%s', client: '%s') panicked: %v",
+		err.EventType, err.View, err.ElementId, err.ClientId, err.Recovered)
+}
+
+func (err *HandlerError) Unwrap() error {
+	if recoveredErr, ok := err.Recovered.(error); ok {
+		return recoveredErr
+	}
+	return nil
+}
+
+func newHandlerError(event *ClientEvent, recovered interface{}, stack []byte) *HandlerError {
+	return &HandlerError{
+		View:      event.View,
+		ElementId: event.Id,
+		EventType: event.Type,
+		ClientId:  event.ClientId,
+		Recovered: recovered,
+		Stack:     stack,
+	}
+}
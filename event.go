@@ -1,5 +1,7 @@
 package gasp
 
+import "crypto/x509"
+
 type ServerEvent struct {
 	Type string                 `json:"type"`
 	Text string                 `json:"text"`
@@ -13,4 +15,20 @@ type ClientEvent struct {
 	Data  map[string]interface{} `json:"data,omitempty"`
 	State FormState              `json:"state"`
 	Form  *Form                  `json:"-"`
+
+	ClientId          string            `json:"-"`
+	Params            map[string]string `json:"-"`
+	Session           *Session          `json:"-"`
+	Principal         *Principal        `json:"-"`
+	ClientCertificate *x509.Certificate `json:"-"`
+
+	propagationStopped bool
+}
+
+func (event *ClientEvent) StopPropagation() {
+	event.propagationStopped = true
+}
+
+func (event *ClientEvent) IsPropagationStopped() bool {
+	return event.propagationStopped
 }
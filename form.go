@@ -1,19 +1,25 @@
 package gasp
 
 import (
+	"crypto/tls"
 	"encoding/base64"
 	"encoding/json"
-	"errors"
 	"fmt"
-	"github.com/gorilla/websocket"
+	"io/fs"
 	"net/http"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"tonysoft.com/gasp/resources"
 )
 
 const (
 	defaultSocket = "127.0.0.1:8800"
+	FormLayout    = "form"
+
+	requireRoleAttribute  = "data-gasp-roles"
+	unauthorizedAttribute = "data-gasp-unauthorized"
 )
 
 type Form struct {
@@ -27,6 +33,10 @@ type Form struct {
 	checkboxCount        int
 	linechartCount       int
 	packetInspectorCount int
+	layout               string
+	blocks               map[string]string
+	stopped              chan struct{}
+	stopOnce             sync.Once
 	ErrorChan            chan error
 	Data                 map[string]interface{}
 }
@@ -34,6 +44,7 @@ type Form struct {
 type FormOptions struct {
 	Socket string
 	Path   string
+	Server ServerOptions
 }
 
 func NewForm(options ...FormOptions) *Form {
@@ -48,7 +59,7 @@ func NewForm(options ...FormOptions) *Form {
 		socket = defaultSocket
 	}
 
-	server, err := NewServer(socket)
+	server, err := NewServerWithOptions(socket, options[0].Server)
 	if err != nil {
 		panic(err)
 	}
@@ -57,19 +68,29 @@ func NewForm(options ...FormOptions) *Form {
 		html:      "",
 		server:    server,
 		viewName:  path,
-		ErrorChan: make(chan error),
+		layout:    FormLayout,
+		blocks:    make(map[string]string),
+		stopped:   make(chan struct{}),
+		ErrorChan: make(chan error, errorChanSize),
 		Data:      make(map[string]interface{}),
 	}
 	server.form = &form
 
+	err = server.AddLayout(FormLayout, resources.FormTemplate)
+	if err != nil {
+		panic(err)
+	}
+
 	go func() {
 		for {
-			serverErr := <-server.ErrorChan
-			if serverErr != nil {
-				form.ErrorChan <- serverErr
-				if errors.Is(serverErr, http.ErrServerClosed) || websocket.IsCloseError(serverErr, websocket.CloseGoingAway) {
-					return
+			select {
+			case serverErr := <-server.ErrorChan:
+				select {
+				case form.ErrorChan <- serverErr:
+				default:
 				}
+			case <-form.stopped:
+				return
 			}
 		}
 	}()
@@ -80,11 +101,7 @@ func NewForm(options ...FormOptions) *Form {
 }
 
 func (form *Form) GetUri() string {
-	if form.server.useTls {
-		return "https://" + form.server.commSocket + "/" + form.viewName
-	} else {
-		return "http://" + form.server.commSocket + "/" + form.viewName
-	}
+	return form.server.GetUri(form.viewName)
 }
 
 func (form *Form) PrintUri() {
@@ -99,6 +116,37 @@ func (form *Form) AddResources(directory string, excludedFileExtensions ...strin
 	return form
 }
 
+func (form *Form) AddLayout(name string, html string) *Form {
+	err := form.server.AddLayout(name, html)
+	if err != nil {
+		panic(err)
+	}
+	return form
+}
+
+func (form *Form) SetLayout(name string) *Form {
+	form.layout = name
+	return form
+}
+
+func (form *Form) SetBlock(name string, html string) *Form {
+	form.blocks[name] = html
+	return form
+}
+
+func (form *Form) AddResourcesFS(prefix string, fsys fs.FS, excludedFileExtensions ...string) *Form {
+	err := form.server.AddResourcesFS(prefix, fsys, excludedFileExtensions...)
+	if err != nil {
+		panic(err)
+	}
+	return form
+}
+
+func (form *Form) Use(middleware ...Middleware) *Form {
+	form.server.Use(middleware...)
+	return form
+}
+
 func (form *Form) AddColumn(attributes ...ControlAttribute) *Form {
 	atts := getAttributesHtml(attributes...)
 	form.html += fmt.Sprintf("</td><td %s class=\"gtabledata\">", atts)
@@ -121,7 +169,7 @@ func (form *Form) AddVariableLabel(variableName string, attributes ...ControlAtt
 	}
 	atts := getAttributesHtml(attributes...)
 
-	form.html += fmt.Sprintf("<label %s class=\"glabel\"><!--%s--></label><br/><br/>", atts, variableName)
+	form.html += fmt.Sprintf("<label %s%s class=\"glabel\"><!--%s--></label><br/><br/>", atts, form.authorizeControl(id.Value, attributes), variableName)
 	form.labelCount++
 	return form
 }
@@ -133,12 +181,20 @@ func (form *Form) AddTextbox(label string, attributes ...ControlAttribute) *Form
 		attributes = append(attributes, *id)
 	}
 	atts := getAttributesHtml(attributes...)
+	auth := form.authorizeControl(id.Value, attributes)
 
 	if label != "" {
-		form.html += fmt.Sprintf("<label class=\"glabel\" for=\"%s\">%s</label>", id.Value, label)
+		form.html += fmt.Sprintf("<label %sclass=\"glabel\" for=\"%s\">%s</label>", auth, id.Value, label)
 	}
 
-	form.html += fmt.Sprintf("<input %s type=\"text\" class=\"gtextbox\" /><br/><br/>", atts)
+	form.html += fmt.Sprintf("<input %s%s type=\"text\" class=\"gtextbox\" /><br/><br/>", atts, auth)
+
+	if inputType := getElementAttributeFromArray("type", attributes...); inputType != nil && strings.EqualFold(inputType.Value, "password") {
+		err := form.server.redactAuditField(id.Value)
+		if err != nil {
+			panic(err)
+		}
+	}
 	form.textboxCount++
 
 	return form
@@ -154,7 +210,7 @@ func (form *Form) AddButton(text string, clickHandler func(event *ClientEvent),
 
 	form.server.AddEventHandler(form.viewName, id.Value, "click", clickHandler)
 
-	form.html += fmt.Sprintf("<button %s class=\"gbutton\" >%s</button><br/><br/>", atts, text)
+	form.html += fmt.Sprintf("<button %s%s class=\"gbutton\" >%s</button><br/><br/>", atts, form.authorizeControl(id.Value, attributes), text)
 	form.buttonCount++
 
 	return form
@@ -168,7 +224,7 @@ func (form *Form) AddLabel(text string, attributes ...ControlAttribute) *Form {
 	}
 	atts := getAttributesHtml(attributes...)
 
-	form.html += fmt.Sprintf("<label %s class=\"glabel\" >%s</label><br/><br/>", atts, text)
+	form.html += fmt.Sprintf("<label %s%s class=\"glabel\" >%s</label><br/><br/>", atts, form.authorizeControl(id.Value, attributes), text)
 	form.labelCount++
 
 	return form
@@ -181,9 +237,10 @@ func (form *Form) AddDropdown(label string, items []string, attributes ...Contro
 		attributes = append(attributes, *id)
 	}
 	atts := getAttributesHtml(attributes...)
+	auth := form.authorizeControl(id.Value, attributes)
 
 	if label != "" {
-		form.html += fmt.Sprintf("<label class=\"glabel\" for=\"%s\">%s</label>", id.Value, label)
+		form.html += fmt.Sprintf("<label %sclass=\"glabel\" for=\"%s\">%s</label>", auth, id.Value, label)
 	}
 
 	itemsHtml := ""
@@ -191,7 +248,7 @@ func (form *Form) AddDropdown(label string, items []string, attributes ...Contro
 		itemsHtml += fmt.Sprintf("<option value=\"%s\">%s</option>", item, item)
 	}
 
-	form.html += fmt.Sprintf("<select %s class=\"gdropdown\" >%s</select><br/><br/>", atts, itemsHtml)
+	form.html += fmt.Sprintf("<select %s%s class=\"gdropdown\" >%s</select><br/><br/>", atts, auth, itemsHtml)
 	form.dropdownCount++
 
 	return form
@@ -204,15 +261,16 @@ func (form *Form) AddCheckbox(label string, attributes ...ControlAttribute) *For
 		attributes = append(attributes, *id)
 	}
 	atts := getAttributesHtml(attributes...)
+	auth := form.authorizeControl(id.Value, attributes)
 
 	lineBreak := ""
 	if label == "" {
 		lineBreak = "<br/><br/>"
 	}
-	form.html += fmt.Sprintf("<input %s type=\"checkbox\" class=\"gcheckbox\"/>%s", atts, lineBreak)
+	form.html += fmt.Sprintf("<input %s%s type=\"checkbox\" class=\"gcheckbox\"/>%s", atts, auth, lineBreak)
 
 	if label != "" {
-		form.html += fmt.Sprintf("<label class=\"glabel\" for=\"%s\">%s</label><br/><br/>", id.Value, label)
+		form.html += fmt.Sprintf("<label %sclass=\"glabel\" for=\"%s\">%s</label><br/><br/>", auth, id.Value, label)
 	}
 
 	form.checkboxCount++
@@ -248,7 +306,7 @@ func (form *Form) AddLineChart(initialState LineChartState, attributes ...Contro
 		panic(err)
 	}
 	initialStateEncoded := base64.StdEncoding.EncodeToString(initialStateJson)
-	form.html += fmt.Sprintf("<canvas %s class=\"glinechart\" width=\"%d\" height=\"%d\" data-initial-state=\"%s\"></canvas>", atts, initialState.Width, initialState.Height, initialStateEncoded)
+	form.html += fmt.Sprintf("<canvas %s%s class=\"glinechart\" width=\"%d\" height=\"%d\" data-initial-state=\"%s\"></canvas>", atts, form.authorizeControl(idAtt.Value, attributes), initialState.Width, initialState.Height, initialStateEncoded)
 	form.linechartCount++
 	return form
 }
@@ -276,7 +334,7 @@ func (form *Form) AddPacketInspector(initialState PacketInspectorState, attribut
 	}
 
 	initialStateEncoded := base64.StdEncoding.EncodeToString(initialStateJson)
-	form.html += fmt.Sprintf("<div %s style=\"width:%dpx;\" class=\"gpacketinspector\" data-initial-state=\"%s\"><canvas width=\"%d\" height=\"275\"></canvas></div>", atts, initialState.Width, initialStateEncoded, initialState.Width)
+	form.html += fmt.Sprintf("<div %s%s style=\"width:%dpx;\" class=\"gpacketinspector\" data-initial-state=\"%s\"><canvas width=\"%d\" height=\"275\"></canvas></div>", atts, form.authorizeControl(idAtt.Value, attributes), initialState.Width, initialStateEncoded, initialState.Width)
 	form.packetInspectorCount++
 	return form
 }
@@ -379,8 +437,7 @@ func (form *Form) GetPacketInspector(id ...string) *PacketInspector {
 
 func (form *Form) Start() (*Form, error) {
 	form.endFormHtml()
-	html := strings.ReplaceAll(resources.FormTemplate, "<!--form-->", form.html)
-	err := form.server.AddView(form.viewName, html)
+	err := form.server.AddView(form.viewName, form.getViewHtml())
 	if err != nil {
 		return form, err
 	}
@@ -389,15 +446,34 @@ func (form *Form) Start() (*Form, error) {
 
 func (form *Form) StartWithTLS(certFile string, keyFile string) error {
 	form.endFormHtml()
-	html := strings.ReplaceAll(resources.FormTemplate, "<!--form-->", form.html)
-	err := form.server.AddView(form.viewName, html)
+	err := form.server.AddView(form.viewName, form.getViewHtml())
 	if err != nil {
 		return err
 	}
 	return form.server.StartWithTLS(certFile, keyFile)
 }
 
+func (form *Form) StartWithTLSConfig(config *tls.Config) error {
+	form.endFormHtml()
+	err := form.server.AddView(form.viewName, form.getViewHtml())
+	if err != nil {
+		return err
+	}
+	return form.server.StartWithTLSConfig(config)
+}
+
+func (form *Form) StartWithAutoTLS() error {
+	form.endFormHtml()
+	err := form.server.AddView(form.viewName, form.getViewHtml())
+	if err != nil {
+		return err
+	}
+	return form.server.StartWithAutoTLS()
+}
+
+// Stop stops the server and the forwarding of its errors to the ErrorChan.
 func (form *Form) Stop() error {
+	defer form.stopOnce.Do(func() { close(form.stopped) })
 	return form.server.Stop()
 }
 
@@ -502,6 +578,22 @@ func (form *Form) UpdatePacketInspector(state *PacketInspectorState, propertiesT
 	form.server.SendEvent(&evt)
 }
 
+func (form *Form) getViewHtml() string {
+	html := "<!--layout:" + form.layout + "-->"
+	html += "<!--block:form-->" + form.html + "<!--/block-->"
+
+	names := make([]string, 0, len(form.blocks))
+	for name := range form.blocks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		html += "<!--block:" + name + "-->" + form.blocks[name] + "<!--/block-->"
+	}
+	return html
+}
+
 func (form *Form) startFormHtml() {
 	form.html = "<div class=\"gform\"><table class=\"gtable\"><tr><td class=\"gtabledata\">"
 }
@@ -510,6 +602,37 @@ func (form *Form) endFormHtml() {
 	form.html += "</td></tr></div>"
 }
 
+// RequireRole restricts a control to principals with one of the roles.  The control
+// is hidden (or disabled, with DisableUnauthorized) for other users, and its events
+// are rejected.
+func RequireRole(roles ...string) ControlAttribute {
+	return ControlAttribute{Key: requireRoleAttribute, Value: strings.Join(roles, ",")}
+}
+
+func DisableUnauthorized() ControlAttribute {
+	return ControlAttribute{Key: unauthorizedAttribute, Value: authorizeDisable}
+}
+
+// authorizeControl rejects the control's events for unauthorized users and returns
+// the variable that renders its attributes for them.
+func (form *Form) authorizeControl(id string, attributes []ControlAttribute) string {
+	roles := getElementAttributeFromArray(requireRoleAttribute, attributes...)
+	if roles == nil {
+		return ""
+	}
+
+	err := form.server.AuthorizeEvents(form.viewName, id, strings.Split(roles.Value, ",")...)
+	if err != nil {
+		panic(err)
+	}
+
+	mode := authorizeHide
+	if getElementAttributeFromArray(unauthorizedAttribute, attributes...) != nil {
+		mode = authorizeDisable
+	}
+	return "<!--" + authorizeVariablePrefix + mode + ":" + roles.Value + "-->"
+}
+
 func getAttributesHtml(attributes ...ControlAttribute) string {
 	html := ""
 	for _, att := range attributes {
@@ -0,0 +1,126 @@
+package gasp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"regexp"
+)
+
+const (
+	fragmentVariablePrefix = "fragment:"
+)
+
+var (
+	fragmentNameRegex = regexp.MustCompile(`^[\w\-]+$`)
+)
+
+type fragment struct {
+	tmpl     *template.Template
+	dataFunc func(req *http.Request) any
+}
+
+// AddFragment registers a named region of HTML that is rendered into views with
+// <!--fragment:name--> or {{fragment "name"}} and can later be re-rendered and
+// pushed to clients with RenderFragment.  The optional dataFunc provides the data
+// used when the fragment is rendered as part of a view.
+func (server *Server) AddFragment(name string, tmpl *template.Template, dataFunc ...func(req *http.Request) any) error {
+	if !fragmentNameRegex.MatchString(name) {
+		return fmt.Errorf("invalid fragment name '%s'", name)
+	}
+
+	if tmpl == nil {
+		return errors.New("parameter 'tmpl' cannot be nil")
+	}
+
+	if _, ok := server.fragments[name]; ok {
+		return fmt.Errorf("fragment '%s' already added", name)
+	}
+
+	f := fragment{tmpl: tmpl}
+	if len(dataFunc) > 0 {
+		f.dataFunc = dataFunc[0]
+	}
+
+	server.fragments[name] = &f
+	return nil
+}
+
+// RenderFragment re-renders the fragment with the given data and sends it to the
+// client, which replaces the fragment's region of the page.  If clientId is empty
+// the fragment is rendered for and sent to every client.
+func (server *Server) RenderFragment(clientId string, name string, data any) error {
+	if _, ok := server.fragments[name]; !ok {
+		return fmt.Errorf("fragment '%s' not found", name)
+	}
+
+	clients := make([]*client, 0)
+	if clientId == "" {
+		clients = server.getClients()
+	} else {
+		server.clientsMutex.RLock()
+		c, ok := server.clients[clientId]
+		server.clientsMutex.RUnlock()
+
+		if !ok {
+			return fmt.Errorf("client '%s' is not connected", clientId)
+		}
+		clients = append(clients, c)
+	}
+
+	for _, c := range clients {
+		html, err := server.executeFragment(name, c.request, data)
+		if err != nil {
+			return err
+		}
+
+		server.enqueueEvent(c, &ServerEvent{
+			Type: "fragment_update",
+			Data: map[string]interface{}{
+				"name": name,
+				"html": html,
+			},
+		})
+	}
+
+	return nil
+}
+
+func (server *Server) renderFragment(name string, req *http.Request, data ...any) (template.HTML, error) {
+	f, ok := server.fragments[name]
+	if !ok {
+		return "", fmt.Errorf("fragment '%s' not found", name)
+	}
+
+	var fragmentData any
+	if len(data) > 0 {
+		fragmentData = data[0]
+	} else if f.dataFunc != nil {
+		fragmentData = f.dataFunc(req)
+	}
+
+	html, err := server.executeFragment(name, req, fragmentData)
+	if err != nil {
+		return "", err
+	}
+
+	return template.HTML(`<div data-gasp-fragment="` + name + `">` + html + `</div>`), nil
+}
+
+func (server *Server) executeFragment(name string, req *http.Request, data any) (string, error) {
+	tmpl, err := server.fragments[name].tmpl.Clone()
+	if err != nil {
+		return "", err
+	}
+	tmpl.Funcs(server.getTemplateFuncs(req))
+
+	buffer := bytes.Buffer{}
+	err = tmpl.Execute(&buffer, data)
+	if err != nil {
+		return "", fmt.Errorf("failed to render fragment '%s': %v", name, err)
+	}
+
+	return buffer.String(), nil
+}
@@ -1,29 +1,50 @@
 package gasp_test
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	crand "crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
 	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
 	"errors"
 	"fmt"
 	"github.com/gorilla/websocket"
+	"html/template"
 	"io"
+	"log/slog"
 	"math"
+	"math/big"
 	"math/rand"
+	"net"
 	"net/http"
+	"net/http/cookiejar"
+	"net/url"
 	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"testing/fstest"
 	"time"
 	ui "tonysoft.com/gasp"
+	"tonysoft.com/gasp/resources"
 )
 
 var (
 	socket = "127.0.0.1:8800"
 )
 
-// NOTE: THESE TESTS MUST BE RUN INDIVIDUALLY SINCE
-// THE http PACKAGE DOES NOT PROVIDE A WAY TO REMOVE
-// A HANDLER AFTER CALLING http.HandleFunc()!
-
 func TestServerStartStop(t *testing.T) {
 	server := getNewServer(t)
 	if server == nil {
@@ -957,7 +978,7 @@ func TestRouteGuards(t *testing.T) {
 	}
 }
 
-func TestResources(t *testing.T) {
+func TestRouteParams(t *testing.T) {
 	server := getNewServer(t)
 	if server == nil {
 		return
@@ -965,35 +986,148 @@ func TestResources(t *testing.T) {
 
 	handleErrorChannel(t, server.ErrorChan)
 
-	err := server.AddResources("resources", ".go", ".sh", ".crt", ".key")
+	err := server.AddVariableSetter("device", func(req *http.Request) string {
+		return ui.RouteParam(req, "id")
+	})
 	if err != nil {
 		t.Error(err)
 		return
 	}
 
-	err = server.Start()
+	err = server.AddView("devices/{id}", "<p>device <!--device--></p>")
 	if err != nil {
 		t.Error(err)
 		return
 	}
 
-	resp, err := getResponse("http://" + socket + "/css/test.css")
+	err = server.AddView("devices/new", "<p>new device</p>")
 	if err != nil {
 		t.Error(err)
 		return
 	}
 
-	if !strings.HasPrefix(resp, ".testClass{}") {
-		t.Errorf("invalid response received: %s", resp)
+	err = server.AddRouteHandler("POST /api/devices", func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = rw.Write([]byte("created"))
+	})
+	if err != nil {
+		t.Error(err)
 		return
 	}
 
-	resp, err = getResponse("http://" + socket + "/certs/test-ca.key")
+	err = server.AddRouteHandler("/files/{path...}", func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = rw.Write([]byte(ui.RouteParam(req, "path")))
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = server.AddRouteHandler("/devices/{id}/{id}", func(rw http.ResponseWriter, req *http.Request) {})
 	if err == nil {
-		t.Error("expected not to be able to download test-ca.key")
+		t.Error("expected duplicate parameter names to be rejected")
+	}
+
+	err = server.AddView("admin/settings", "settings")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = server.AddView("login", "login")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = server.AddRouteGuard("admin/", func(req *http.Request) *string {
+		newPath := "login"
+		return &newPath
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	eventParams := make(chan map[string]string, 1)
+	server.AddEventHandler("devices/*", "gbutton0", "click", func(event *ui.ClientEvent) {
+		eventParams <- event.Params
+	})
+
+	err = server.Start()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	expected := map[string]string{
+		"/devices/42":         "<p>device 42</p>",
+		"/devices/new":        "<p>new device</p>",
+		"/files/css/site.css": "css/site.css",
+		"/admin/settings":     "login",
+	}
+	for path, body := range expected {
+		resp, err := getResponse("http://" + socket + path)
+		if err != nil {
+			t.Errorf("%s: %v", path, err)
+		} else if resp != body {
+			t.Errorf("invalid response received for %s: %s", path, resp)
+		}
+	}
+
+	resp, err := http.Get("http://" + socket + "/api/devices")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed || resp.Header.Get("Allow") != "POST" {
+		t.Errorf("expected GET to be rejected, got: %d %s", resp.StatusCode, resp.Header.Get("Allow"))
+	}
+
+	resp, err = http.Post("http://"+socket+"/api/devices", "text/plain", nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected POST to be accepted, got: %d", resp.StatusCode)
+	}
+
+	resp, err = http.Get("http://" + socket + "/devices/42/missing")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected unmatched path to not be found, got: %d", resp.StatusCode)
+	}
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws://"+socket+"/gaspws"+getCsrfQuery(server), nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = ws.WriteJSON(ui.ClientEvent{View: "devices/42", Id: "gbutton0", Type: "click"})
+	if err != nil {
+		t.Error(err)
 		return
 	}
 
+	select {
+	case params := <-eventParams:
+		if params["id"] != "42" {
+			t.Errorf("unexpected event params: %v", params)
+		}
+	case <-time.After(time.Second):
+		t.Error("event was not handled")
+	}
+
+	_ = ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""))
+	_ = ws.Close()
+
 	err = server.Stop()
 	if err != nil {
 		t.Error(err)
@@ -1001,7 +1135,24 @@ func TestResources(t *testing.T) {
 	}
 }
 
-func TestVariables1(t *testing.T) {
+type lockedBuffer struct {
+	mutex  sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buffer.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buffer.String()
+}
+
+func TestMiddleware(t *testing.T) {
 	server := getNewServer(t)
 	if server == nil {
 		return
@@ -1009,16 +1160,34 @@ func TestVariables1(t *testing.T) {
 
 	handleErrorChannel(t, server.ErrorChan)
 
-	hostname, _ := os.Hostname()
+	logBuffer := &lockedBuffer{}
+	logger := slog.New(slog.NewTextHandler(logBuffer, nil))
+	paths := make(chan string, 10)
+	panics := make(chan interface{}, 1)
+
+	server.Use(
+		ui.AddRequestIds(),
+		ui.LogRequests(logger),
+		ui.RecoverRequests(func(req *http.Request, recovered interface{}, stack []byte) {
+			panics <- recovered
+		}),
+		ui.Cors(ui.CorsOptions{AllowedOrigins: []string{"http://example.com"}, MaxAge: time.Hour}),
+		func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				paths <- req.URL.Path
+				next.ServeHTTP(rw, req)
+			})
+		},
+	)
 
-	err := server.AddView("", "<!--hostname-->")
+	err := server.AddView("test", "test")
 	if err != nil {
 		t.Error(err)
 		return
 	}
 
-	err = server.AddVariableSetter("hostname", func(req *http.Request) string {
-		return hostname
+	err = server.AddRouteHandler("panic", func(rw http.ResponseWriter, req *http.Request) {
+		panic("something went wrong")
 	})
 	if err != nil {
 		t.Error(err)
@@ -1031,119 +1200,2989 @@ func TestVariables1(t *testing.T) {
 		return
 	}
 
-	resp, err := getResponse("http://" + socket + "/")
+	req, _ := http.NewRequest(http.MethodGet, "http://"+socket+"/test", nil)
+	req.Header.Set("X-Request-ID", "abc123")
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		t.Error(err)
 		return
 	}
+	_ = resp.Body.Close()
 
-	if resp != hostname {
-		t.Errorf("invalid response received: %s", resp)
+	if resp.Header.Get("X-Request-ID") != "abc123" {
+		t.Errorf("expected request ID to be returned, got: %s", resp.Header.Get("X-Request-ID"))
+	}
+
+	if <-paths != "/test" {
+		t.Error("custom middleware was not called")
+	}
+
+	resp, err = http.Get("http://" + socket + "/panic")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	_ = resp.Body.Close()
+
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("expected panic to be recovered with a 500, got: %d", resp.StatusCode)
+	}
+
+	select {
+	case recovered := <-panics:
+		if recovered != "something went wrong" {
+			t.Errorf("unexpected panic: %v", recovered)
+		}
+	case <-time.After(time.Second):
+		t.Error("panic was not reported")
+	}
+	<-paths
+
+	req, _ = http.NewRequest(http.MethodOptions, "http://"+socket+"/test", nil)
+	req.Header.Set("Origin", "http://example.com")
+	req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	_ = resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent || resp.Header.Get("Access-Control-Allow-Origin") != "http://example.com" || resp.Header.Get("Access-Control-Max-Age") != "3600" {
+		t.Errorf("invalid preflight response: %d %v", resp.StatusCode, resp.Header)
+	}
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws://"+socket+"/gaspws"+getCsrfQuery(server), nil)
+	if err != nil {
+		t.Error(err)
 		return
 	}
 
+	if <-paths != "/gaspws" {
+		t.Error("middleware was not applied to the WebSockets upgrade")
+	}
+
+	_ = ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""))
+	_ = ws.Close()
+
+	for i := 0; i < 100 && !strings.Contains(logBuffer.String(), "path=/gaspws"); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
 	err = server.Stop()
 	if err != nil {
 		t.Error(err)
 		return
 	}
+
+	logs := logBuffer.String()
+	if !strings.Contains(logs, "path=/test status=200") || !strings.Contains(logs, "request_id=abc123") || !strings.Contains(logs, "path=/panic status=500") {
+		t.Errorf("requests were not logged: %s", logs)
+	}
+
+	if !strings.Contains(logs, "path=/gaspws status=101") {
+		t.Errorf("the WebSockets upgrade was not logged: %s", logs)
+	}
 }
 
-// NOTE THIS TEST REQUIRES MANUAL INTERVENTION!
-func TestVariables2(t *testing.T) {
-	hostname, err := os.Hostname()
+func TestGuardDecisions(t *testing.T) {
+	server := getNewServer(t)
+	if server == nil {
+		return
+	}
+
+	handleErrorChannel(t, server.ErrorChan)
+
+	err := server.AddVariableSetter("device", func(req *http.Request) string {
+		return ui.RouteParam(req, "id")
+	})
 	if err != nil {
 		t.Error(err)
 		return
 	}
 
-	buttonClicked := false
+	viewRendered := false
+	err = server.AddRouteHandler("private/data", func(rw http.ResponseWriter, req *http.Request) {
+		viewRendered = true
+		_, _ = rw.Write([]byte("secret"))
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
 
-	form := ui.NewForm().
-		AddVariableSetter("hostname", func(req *http.Request) string {
-			return hostname
-		}).
-		AddVariableLabel("hostname").
-		AddButton("Run Test", func(event *ui.ClientEvent) {
-			t.Log("button clicked")
+	err = server.AddView("devices/{id}", "device <!--device-->")
+	if err != nil {
+		t.Error(err)
+		return
+	}
 
-			labelText := event.State.Labels[0].Text
-			if labelText != hostname {
-				t.Error(fmt.Errorf("label text '%s' does not match expected value ('%s')", labelText, hostname))
-				return
-			}
-			buttonClicked = true
+	err = server.AddGuard("private/", func(req *http.Request) ui.GuardDecision {
+		switch req.URL.Query().Get("user") {
+		case "admin":
+			return ui.AllowRequest()
+		case "":
+			return ui.RedirectRequest("login", http.StatusSeeOther)
+		default:
+			return ui.DenyRequest(http.StatusUnauthorized, "not an admin")
+		}
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for _, path := range []string{"/gaspws", "gaspws", "GET /gaspws", "/gaspws/"} {
+		err = server.AddGuard(path, func(req *http.Request) ui.GuardDecision {
+			return ui.DenyRequest(http.StatusForbidden)
 		})
+		if err == nil {
+			t.Errorf("expected guarding '%s' to be rejected, as it's reserved for the WebSockets channel", path)
+		}
+	}
 
-	handleErrorChannel(t, form.ErrorChan)
+	err = server.AddRouteGuard("/gaspws", func(req *http.Request) *string { return nil })
+	if err == nil {
+		t.Error("expected route guarding '/gaspws' to be rejected, as it's reserved for the WebSockets channel")
+	}
 
-	_, err = form.Start()
+	err = server.AddGuard("legacy/{id}", func(req *http.Request) ui.GuardDecision {
+		return ui.RewriteRequest("devices/" + ui.RouteParam(req, "id"))
+	})
 	if err != nil {
 		t.Error(err)
 		return
 	}
 
-	t.Logf("ACCESS THE UI WITHIN 10 SECONDS TO COMPLETE THE TEST: http://%s", socket)
-	time.Sleep(10 * time.Second)
+	err = server.AddRouteHandler("legacy/{id}", func(rw http.ResponseWriter, req *http.Request) {})
+	if err != nil {
+		t.Error(err)
+		return
+	}
 
-	err = form.Stop()
+	err = server.Start()
 	if err != nil {
 		t.Error(err)
 		return
 	}
 
-	if !buttonClicked {
-		t.Error("button was not clicked or a failure occurred")
+	client := http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	resp, err := client.Get("http://localhost:8800/private/data")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	body, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+
+	if resp.StatusCode != http.StatusSeeOther || resp.Header.Get("Location") != "/login" || strings.Contains(string(body), "secret") {
+		t.Errorf("invalid redirect response: %d %s %s", resp.StatusCode, resp.Header.Get("Location"), body)
+	}
+
+	resp, err = client.Get("http://" + socket + "/private/data?user=guest")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	body, _ = io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+
+	if resp.StatusCode != http.StatusUnauthorized || strings.TrimSpace(string(body)) != "not an admin" {
+		t.Errorf("invalid deny response: %d %s", resp.StatusCode, body)
+	}
+
+	if viewRendered {
+		t.Error("guarded handler was called for a denied request")
+	}
+
+	resp2, err := getResponse("http://" + socket + "/private/data?user=admin")
+	if err != nil || resp2 != "secret" {
+		t.Errorf("expected request to be allowed: %s %v", resp2, err)
+	}
+
+	resp2, err = getResponse("http://" + socket + "/legacy/7")
+	if err != nil || resp2 != "device 7" {
+		t.Errorf("expected request to be rewritten: %s %v", resp2, err)
+	}
+
+	err = server.Stop()
+	if err != nil {
+		t.Error(err)
 		return
 	}
 }
 
-// NOTE THIS TEST REQUIRES MANUAL INTERVENTION!
-func TestTLS(t *testing.T) {
-	buttonClicked := false
+func TestSessions(t *testing.T) {
+	store, err := ui.NewFileSessionStore(t.TempDir())
+	if err != nil {
+		t.Error(err)
+		return
+	}
 
-	form := ui.NewForm().
-		AddButton("Run Test", func(event *ui.ClientEvent) {
-			t.Log("button clicked")
-			buttonClicked = true
-		})
+	server, err := ui.NewServerWithOptions(socket, ui.ServerOptions{
+		Sessions: ui.SessionOptions{Store: store, Secret: []byte("0123456789abcdef0123456789abcdef")},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
 
-	handleErrorChannel(t, form.ErrorChan)
+	handleErrorChannel(t, server.ErrorChan)
 
-	err := form.StartWithTLS("resources/certs/test-server.crt", "resources/certs/test-server.key")
+	err = server.AddVariableSetter("user", func(req *http.Request) string {
+		return ui.GetSession(req).Get("user")
+	})
 	if err != nil {
 		t.Error(err)
 		return
 	}
 
-	t.Logf("ACCESS THE UI WITHIN 10 SECONDS TO COMPLETE THE TEST: %s", form.GetUri())
-	time.Sleep(10 * time.Second)
+	err = server.AddView("home", "user <!--user-->")
+	if err != nil {
+		t.Error(err)
+		return
+	}
 
-	err = form.Stop()
+	err = server.AddRouteHandler("login", func(rw http.ResponseWriter, req *http.Request) {
+		ui.GetSession(req).Set("user", req.URL.Query().Get("user"))
+	})
 	if err != nil {
 		t.Error(err)
 		return
 	}
 
-	if !buttonClicked {
-		t.Error("button was not clicked or a failure occurred")
+	err = server.AddRouteHandler("clicks", func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = rw.Write([]byte(ui.GetSession(req).Get("clicks")))
+	})
+	if err != nil {
+		t.Error(err)
 		return
 	}
-}
 
-func getNewServer(t *testing.T) *ui.Server {
-	server, err := ui.NewServer(socket)
+	err = server.AddRouteHandler("csrf", func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = rw.Write([]byte(server.GenerateCsrfToken(req)))
+	})
 	if err != nil {
 		t.Error(err)
-		return nil
+		return
 	}
-	return server
-}
 
-func handleErrorChannel(t *testing.T, errorChan chan error) {
-	go func() {
-		for {
-			err := <-errorChan
+	users := make(chan string, 1)
+	server.AddEventHandler("home", "gbutton0", "click", func(event *ui.ClientEvent) {
+		event.Session.Set("clicks", "1")
+		users <- event.Session.Get("user")
+	})
+
+	err = server.Start()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	jar, _ := cookiejar.New(nil)
+	client := http.Client{Jar: jar}
+	get := func(path string) string {
+		resp, err := client.Get("http://" + socket + "/" + path)
+		if err != nil {
+			t.Error(err)
+			return ""
+		}
+		body, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		return string(body)
+	}
+
+	get("login?user=alice")
+	if body := get("home"); body != "user alice" {
+		t.Errorf("session value was not kept: %s", body)
+	}
+
+	serverUrl, _ := url.Parse("http://" + socket + "/")
+	cookies := jar.Cookies(serverUrl)
+	if len(cookies) != 1 || cookies[0].Name != "gasp_session" {
+		t.Errorf("expected a session cookie, got: %v", cookies)
+		return
+	}
+
+	tamperedJar, _ := cookiejar.New(nil)
+	tamperedJar.SetCookies(serverUrl, []*http.Cookie{{Name: "gasp_session", Value: cookies[0].Value[:32] + ".invalid"}})
+	client.Jar = tamperedJar
+	if body := get("home"); body != "user " {
+		t.Errorf("session with an invalid signature was accepted: %s", body)
+	}
+	client.Jar = jar
+
+	header := http.Header{}
+	header.Set("Cookie", "gasp_session="+cookies[0].Value)
+	ws, _, err := websocket.DefaultDialer.Dial("ws://"+socket+"/gaspws"+"?csrf_token="+url.QueryEscape(get("csrf")), header)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = ws.WriteJSON(ui.ClientEvent{View: "home", Id: "gbutton0", Type: "click"})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	select {
+	case user := <-users:
+		if user != "alice" {
+			t.Errorf("invalid event session user: %s", user)
+		}
+	case <-time.After(time.Second):
+		t.Error("event handler was not called")
+	}
+
+	if body := get("clicks"); body != "1" {
+		t.Errorf("session value set by event handler was not saved: %s", body)
+	}
+
+	_ = ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""))
+	_ = ws.Close()
+
+	err = server.Stop()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	data, err := store.Load(cookies[0].Value[:32])
+	if err != nil || data == nil || data.Values["user"] != "alice" {
+		t.Errorf("session was not stored: %v %v", data, err)
+	}
+}
+
+func TestAuthentication(t *testing.T) {
+	server, err := ui.NewServerWithOptions(socket, ui.ServerOptions{
+		Auth: ui.AuthOptions{
+			Authenticator: ui.AnyAuthenticator(
+				ui.BasicAuth("gasp", map[string]string{"alice": "secret"}),
+				ui.BearerTokens(map[string]*ui.Principal{"token123": {Name: "monitor", Roles: []string{"viewer"}}}),
+			),
+			PublicPaths: []string{"public/"},
+		},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	handleErrorChannel(t, server.ErrorChan)
+
+	err = server.AddVariableSetter("user", func(req *http.Request) string {
+		if principal := ui.GetPrincipal(req); principal != nil {
+			return principal.Name
+		}
+		return "anonymous"
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for _, path := range []string{"home", "public/info"} {
+		err = server.AddView(path, "user <!--user-->")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	principals := make(chan *ui.Principal, 1)
+	server.AddEventHandler("home", "gbutton0", "click", func(event *ui.ClientEvent) {
+		principals <- event.Principal
+	})
+
+	err = server.Start()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	get := func(path string, setAuth func(req *http.Request)) (int, string) {
+		req, _ := http.NewRequest(http.MethodGet, "http://"+socket+"/"+path, nil)
+		if setAuth != nil {
+			setAuth(req)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Error(err)
+			return 0, ""
+		}
+		body, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if resp.StatusCode == http.StatusUnauthorized && !strings.HasPrefix(resp.Header.Get("WWW-Authenticate"), "Basic") {
+			t.Errorf("missing challenge: %v", resp.Header)
+		}
+		return resp.StatusCode, string(body)
+	}
+
+	if status, _ := get("home", nil); status != http.StatusUnauthorized {
+		t.Errorf("expected unauthenticated request to be rejected, got: %d", status)
+	}
+
+	if status, _ := get("home", func(req *http.Request) { req.SetBasicAuth("alice", "wrong") }); status != http.StatusUnauthorized {
+		t.Errorf("expected invalid password to be rejected, got: %d", status)
+	}
+
+	if status, body := get("home", func(req *http.Request) { req.SetBasicAuth("alice", "secret") }); status != http.StatusOK || body != "user alice" {
+		t.Errorf("expected basic auth to succeed: %d %s", status, body)
+	}
+
+	if status, body := get("home", func(req *http.Request) { req.Header.Set("Authorization", "Bearer token123") }); status != http.StatusOK || body != "user monitor" {
+		t.Errorf("expected bearer token to succeed: %d %s", status, body)
+	}
+
+	if status, body := get("public/info", nil); status != http.StatusOK || body != "user anonymous" {
+		t.Errorf("expected public path to be served: %d %s", status, body)
+	}
+
+	_, _, err = websocket.DefaultDialer.Dial("ws://"+socket+"/gaspws"+getCsrfQuery(server), nil)
+	if err == nil {
+		t.Error("expected unauthenticated WebSockets upgrade to be rejected")
+	}
+
+	header := http.Header{}
+	header.Set("Authorization", "Bearer token123")
+	ws, _, err := websocket.DefaultDialer.Dial("ws://"+socket+"/gaspws"+getCsrfQuery(server), header)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = ws.WriteJSON(ui.ClientEvent{View: "home", Id: "gbutton0", Type: "click"})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	select {
+	case principal := <-principals:
+		if principal == nil || principal.Name != "monitor" || !principal.HasRole("viewer") {
+			t.Errorf("invalid event principal: %v", principal)
+		}
+	case <-time.After(time.Second):
+		t.Error("event handler was not called")
+	}
+
+	_ = ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""))
+	_ = ws.Close()
+
+	err = server.Stop()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+}
+
+func TestOriginAndCsrf(t *testing.T) {
+	server, err := ui.NewServer(socket)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	rejections := make(chan error, 10)
+	go func() {
+		for {
+			err := <-server.ErrorChan
+			if errors.Is(err, http.ErrServerClosed) {
+				return
+			}
+			rejections <- err
+		}
+	}()
+
+	err = server.AddView("test", "<html><body><!--gasp_js--></body></html>")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = server.Start()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	page, err := getResponse("http://" + socket + "/test")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	match := regexp.MustCompile(`"csrf_token":"([^"]+)"`).FindStringSubmatch(page)
+	if match == nil {
+		t.Errorf("view does not contain a CSRF token: %s", page)
+		return
+	}
+	token := match[1]
+
+	dial := func(origin string, token string) error {
+		header := http.Header{}
+		if origin != "" {
+			header.Set("Origin", origin)
+		}
+		ws, _, err := websocket.DefaultDialer.Dial("ws://"+socket+"/gaspws?csrf_token="+url.QueryEscape(token), header)
+		if err != nil {
+			return err
+		}
+		_ = ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""))
+		return ws.Close()
+	}
+
+	expectRejection := func(expected error) {
+		select {
+		case err := <-rejections:
+			if !errors.Is(err, expected) {
+				t.Errorf("expected %v, got: %v", expected, err)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("rejection was not reported: %v", expected)
+		}
+	}
+
+	if dial("http://evil.example.com", token) == nil {
+		t.Error("expected cross-origin upgrade to be rejected")
+	}
+	expectRejection(ui.ErrOriginNotAllowed)
+
+	if dial("http://"+socket, "") == nil {
+		t.Error("expected upgrade without a CSRF token to be rejected")
+	}
+	expectRejection(ui.ErrInvalidCsrfToken)
+
+	if dial("http://"+socket, token[:len(token)-2]+"xx") == nil {
+		t.Error("expected upgrade with a tampered CSRF token to be rejected")
+	}
+	expectRejection(ui.ErrInvalidCsrfToken)
+
+	err = dial("http://"+socket, token)
+	if err != nil {
+		t.Errorf("expected same-origin upgrade with a valid token to succeed: %v", err)
+	}
+
+	err = server.Stop()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+}
+
+func TestCsrfTokenOptOut(t *testing.T) {
+	server, err := ui.NewServerWithOptions(socket, ui.ServerOptions{DisableCsrfToken: true})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	handleErrorChannel(t, server.ErrorChan)
+
+	err = server.AddView("test", "<html><body><!--gasp_js--></body></html>")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = server.Start()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	page, err := getResponse("http://" + socket + "/test")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if strings.Contains(page, "csrf_token") {
+		t.Errorf("expected the view not to contain a CSRF token: %s", page)
+	}
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws://"+socket+"/gaspws", nil)
+	if err != nil {
+		t.Errorf("expected upgrade without a CSRF token to succeed: %v", err)
+	} else {
+		_ = ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""))
+		_ = ws.Close()
+	}
+
+	err = server.Stop()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+}
+
+func TestWebsocketLimits(t *testing.T) {
+	server, err := ui.NewServerWithOptions(socket, ui.ServerOptions{
+		MaxMessageSize:  1024,
+		RateLimit:       ui.RateLimit{Rate: 1000, Burst: 100},
+		EventRateLimits: map[string]ui.RateLimit{"mousemove": {Rate: 1, Burst: 2}},
+		IdleTimeout:     500 * time.Millisecond,
+		PingInterval:    100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	go func() {
+		for err := range server.ErrorChan {
+			if errors.Is(err, http.ErrServerClosed) {
+				return
+			}
+		}
+	}()
+
+	events := make(chan string, 100)
+	server.AddEventHandler("test", "*", "*", func(event *ui.ClientEvent) {
+		events <- event.Type
+	})
+
+	err = server.Start()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws://"+socket+"/gaspws"+getCsrfQuery(server), nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	go func() {
+		for {
+			if _, _, err := ws.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < 5; i++ {
+		_ = ws.WriteJSON(ui.ClientEvent{View: "test", Id: "canvas", Type: "mousemove"})
+	}
+	_ = ws.WriteJSON(ui.ClientEvent{View: "test", Id: "gbutton0", Type: "click"})
+
+	counts := make(map[string]int)
+	timeout := time.After(time.Second)
+collect:
+	for {
+		select {
+		case eventType := <-events:
+			counts[eventType]++
+		case <-timeout:
+			break collect
+		}
+	}
+
+	if counts["mousemove"] != 2 || counts["click"] != 1 {
+		t.Errorf("rate limits were not applied: %v", counts)
+	}
+
+	_ = ws.WriteJSON(ui.ClientEvent{View: "test", Id: "gbutton0", Type: "click"})
+	select {
+	case <-events:
+	case <-time.After(time.Second):
+		t.Error("connection kept alive by pongs was closed")
+	}
+
+	oversizedWs, _, err := websocket.DefaultDialer.Dial("ws://"+socket+"/gaspws"+getCsrfQuery(server), nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	_ = oversizedWs.WriteJSON(ui.ClientEvent{View: "test", Id: strings.Repeat("x", 2048), Type: "click"})
+
+	idleWs, _, err := websocket.DefaultDialer.Dial("ws://"+socket+"/gaspws"+getCsrfQuery(server), nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	time.Sleep(time.Second)
+
+	stats := server.ThrottleStats()
+	if stats.Throttled != 3 || stats.ThrottledByType["mousemove"] != 3 || stats.Oversized != 1 || stats.TimedOut != 1 {
+		t.Errorf("invalid throttle stats: %+v", stats)
+	}
+
+	select {
+	case eventType := <-events:
+		t.Errorf("oversized event was handled: %s", eventType)
+	default:
+	}
+
+	_ = ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""))
+	_ = ws.Close()
+	_ = oversizedWs.Close()
+	_ = idleWs.Close()
+
+	err = server.Stop()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+}
+
+func TestEventRateLimitsIgnoreUnconfiguredTypes(t *testing.T) {
+	server, err := ui.NewServerWithOptions(socket, ui.ServerOptions{
+		EventRateLimits: map[string]ui.RateLimit{"mousemove": {Rate: 1, Burst: 1}},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	handleErrorChannel(t, server.ErrorChan)
+
+	done := make(chan bool, 1)
+	server.AddEventHandler("test", "*", "done", func(event *ui.ClientEvent) {
+		done <- true
+	})
+
+	err = server.Start()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws://"+socket+"/gaspws"+getCsrfQuery(server), nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	var before runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	padding := strings.Repeat("x", 1024)
+	for i := 0; i < 50000; i++ {
+		err = ws.WriteJSON(ui.ClientEvent{View: "test", Id: "canvas", Type: padding + strconv.Itoa(i)})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	_ = ws.WriteJSON(ui.ClientEvent{View: "test", Id: "canvas", Type: "done"})
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Error("the events were not handled")
+	}
+
+	var after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+
+	if growth := int64(after.HeapAlloc) - int64(before.HeapAlloc); growth > 16*1024*1024 {
+		t.Errorf("expected the event types not to be retained, the heap grew by %d bytes", growth)
+	}
+
+	if stats := server.ThrottleStats(); stats.Throttled != 0 {
+		t.Errorf("expected no events to be throttled: %+v", stats)
+	}
+
+	_ = ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""))
+	_ = ws.Close()
+
+	err = server.Stop()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+}
+
+func TestTemplateView(t *testing.T) {
+	server := getNewServer(t)
+	if server == nil {
+		return
+	}
+
+	handleErrorChannel(t, server.ErrorChan)
+
+	tmpl, err := template.New("test").Funcs(ui.TemplateFuncs()).Parse(
+		`<p>{{.Name}}</p><p>{{var "greeting"}}</p>{{range .Items}}<i>{{.}}</i>{{end}}<script>GASP.init('{{server_socket}}')</script>{{now "2006"}}`)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = server.AddVariableSetter("greeting", func(req *http.Request) string {
+		return "<b>hello</b>"
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = server.AddTemplateView("test", tmpl, func(req *http.Request) any {
+		return struct {
+			Name  string
+			Items []string
+		}{
+			Name:  req.URL.Query().Get("name"),
+			Items: []string{"a", "b"},
+		}
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = server.Start()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	resp, err := getResponse("http://" + socket + "/test?name=%3Cscript%3Ealert(1)%3C/script%3E")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	expected := fmt.Sprintf("<p>&lt;script&gt;alert(1)&lt;/script&gt;</p><p>&lt;b&gt;hello&lt;/b&gt;</p><i>a</i><i>b</i><script>GASP.init('%s')</script>%d", socket, time.Now().UTC().Year())
+	if resp != expected {
+		t.Errorf("invalid response received: %s", resp)
+	}
+
+	err = server.Stop()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+}
+
+func TestFragments(t *testing.T) {
+	server := getNewServer(t)
+	if server == nil {
+		return
+	}
+
+	handleErrorChannel(t, server.ErrorChan)
+
+	fragmentTmpl := template.Must(template.New("status").Funcs(ui.TemplateFuncs()).Parse(`<span class="glabel" id="status">{{.}}</span>`))
+	err := server.AddFragment("status", fragmentTmpl, func(req *http.Request) any {
+		return req.URL.Query().Get("status")
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = server.AddFragment("status", fragmentTmpl)
+	if err == nil {
+		t.Error("expected duplicate fragment to be rejected")
+	}
+
+	err = server.AddView("test", "<main><!--fragment:status--></main>")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	viewTmpl := template.Must(template.New("test").Funcs(ui.TemplateFuncs()).Parse(`<main>{{fragment "status" .}}</main>`))
+	err = server.AddTemplateView("test2", viewTmpl, func(req *http.Request) any {
+		return "<b>from template</b>"
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = server.Start()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	resp, err := getResponse("http://" + socket + "/test?status=initial")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	expected := `<main><div data-gasp-fragment="status"><span class="glabel" id="status">initial</span></div></main>`
+	if resp != expected {
+		t.Errorf("invalid response received: %s", resp)
+	}
+
+	resp, err = getResponse("http://" + socket + "/test2")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	expected = `<main><div data-gasp-fragment="status"><span class="glabel" id="status">&lt;b&gt;from template&lt;/b&gt;</span></div></main>`
+	if resp != expected {
+		t.Errorf("invalid response received: %s", resp)
+	}
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws://"+socket+"/gaspws"+getCsrfQuery(server), nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	info := ui.ServerEvent{}
+	err = ws.ReadJSON(&info)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	clientId, _ := info.Data["client_id"].(string)
+
+	err = server.RenderFragment(clientId, "missing", nil)
+	if err == nil {
+		t.Error("expected unknown fragment to be rejected")
+	}
+
+	err = server.RenderFragment(clientId, "status", "updated")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	update := ui.ServerEvent{}
+	_ = ws.SetReadDeadline(time.Now().Add(time.Second))
+	err = ws.ReadJSON(&update)
+	if err != nil {
+		t.Error(err)
+	} else if update.Type != "fragment_update" || update.Data["name"] != "status" || update.Data["html"] != `<span class="glabel" id="status">updated</span>` {
+		t.Errorf("unexpected fragment update: %v", update)
+	}
+
+	_ = ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""))
+	_ = ws.Close()
+
+	err = server.Stop()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+}
+
+func TestLayouts(t *testing.T) {
+	server := getNewServer(t)
+	if server == nil {
+		return
+	}
+
+	handleErrorChannel(t, server.ErrorChan)
+
+	err := server.AddLayout("base", `<title><!--block:title-->Default<!--/block--></title><nav><!--block:nav-->Home<!--/block--></nav><main><!--block:content--><!--/block--></main>`)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = server.AddLayout("section", `<!--layout:base--><!--block:nav-->Home | Devices<!--/block-->`)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = server.AddLayout("broken", `<!--block:content-->`)
+	if err == nil {
+		t.Error("expected unclosed block to be rejected")
+	}
+
+	err = server.AddLayout("loop", `<!--layout:loop-->`)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = server.AddView("test", `<!--layout:section--><!--block:title-->Devices<!--/block--><!--block:content--><p><!--now:2006--></p><!--/block-->`)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = server.AddView("test2", `<!--layout:missing-->`)
+	if err == nil {
+		t.Error("expected view with a missing layout to be rejected")
+	}
+
+	err = server.AddView("test3", `<!--layout:loop-->`)
+	if err == nil {
+		t.Error("expected view with a recursive layout to be rejected")
+	}
+
+	err = server.Start()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	resp, err := getResponse("http://" + socket + "/test")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	expected := fmt.Sprintf("<title>Devices</title><nav>Home | Devices</nav><main><p>%d</p></main>", time.Now().UTC().Year())
+	if resp != expected {
+		t.Errorf("invalid response received: %s", resp)
+	}
+
+	err = server.Stop()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+}
+
+func TestFormLayout(t *testing.T) {
+	form := ui.NewForm(ui.FormOptions{Socket: socket, Path: "test"}).
+		AddLayout("branded", `<!--layout:form--><!--block:header--><h1>ACME</h1><!--/block-->`).
+		SetLayout("branded").
+		SetBlock("title", "ACME Monitor").
+		AddLabel("Status")
+
+	handleErrorChannel(t, form.ErrorChan)
+
+	_, err := form.Start()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	resp, err := getResponse(form.GetUri())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if !strings.Contains(resp, "<title>ACME Monitor</title>") || !strings.Contains(resp, "<h1>ACME</h1>") || !strings.Contains(resp, `class="glabel" >Status</label>`) {
+		t.Errorf("invalid response received: %s", resp)
+	}
+
+	if strings.Contains(resp, "<!--block:") || strings.Contains(resp, "<!--/block-->") {
+		t.Errorf("block comments were not removed: %s", resp)
+	}
+
+	err = form.Stop()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+}
+
+func TestPacketInspectorUpdateCopiesBytes(t *testing.T) {
+	form := ui.NewForm(ui.FormOptions{Socket: socket, Path: "test", Server: ui.ServerOptions{QueuePolicy: ui.QueueBlock, DisableCoalescing: true}}).
+		AddPacketInspector(ui.PacketInspectorState{})
+
+	handleErrorChannel(t, form.ErrorChan)
+
+	_, err := form.Start()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws://"+socket+"/gaspws"+getPageCsrfQuery(t, form.GetUri(), nil), nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	info := ui.ServerEvent{}
+	err = ws.ReadJSON(&info)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	updateCount := 1000
+	buffer := make([]byte, 4)
+	for i := 0; i < updateCount; i++ {
+		binary.BigEndian.PutUint32(buffer, uint32(i))
+		form.GetPacketInspector().UpdateBytes(buffer)
+	}
+	binary.BigEndian.PutUint32(buffer, math.MaxUint32)
+
+	received := 0
+	_ = ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for received < updateCount {
+		_, msg, err := ws.ReadMessage()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		events := make([]ui.ServerEvent, 0)
+		if msg[0] == '[' {
+			err = json.Unmarshal(msg, &events)
+		} else {
+			evt := ui.ServerEvent{}
+			err = json.Unmarshal(msg, &evt)
+			events = append(events, evt)
+		}
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		for _, evt := range events {
+			packet, err := base64.StdEncoding.DecodeString(evt.Data["state"].(map[string]interface{})["packet"].(string))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			if len(packet) != 4 || binary.BigEndian.Uint32(packet) != uint32(received) {
+				t.Errorf("expected packet %d, got %v", received, packet)
+				return
+			}
+			received++
+		}
+	}
+
+	_ = ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""))
+	_ = ws.Close()
+
+	err = form.Stop()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+}
+
+func TestFormStopReleasesErrorForwarder(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	for i := 0; i < 50; i++ {
+		err := ui.NewForm(ui.FormOptions{Socket: socket, Path: "test"}).Stop()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	after := runtime.NumGoroutine()
+	for i := 0; i < 100 && after > before; i++ {
+		time.Sleep(10 * time.Millisecond)
+		after = runtime.NumGoroutine()
+	}
+
+	if after > before {
+		t.Errorf("expected stopped forms not to leave goroutines behind (before: %d, after: %d)", before, after)
+	}
+}
+
+func TestRoleAuthorization(t *testing.T) {
+	restarts := make(chan string, 1)
+	refreshes := make(chan string, 1)
+
+	form := ui.NewForm(ui.FormOptions{Socket: socket, Path: "test", Server: ui.ServerOptions{
+		Auth: ui.AuthOptions{Authenticator: ui.BearerTokens(map[string]*ui.Principal{
+			"admintoken":  {Name: "alice", Roles: []string{"admin"}},
+			"viewertoken": {Name: "bob", Roles: []string{"viewer"}},
+		})},
+	}}).
+		AddButton("Restart", func(event *ui.ClientEvent) {
+			restarts <- event.Principal.Name
+		}, ui.RequireRole("admin")).
+		AddButton("Refresh", func(event *ui.ClientEvent) {
+			refreshes <- event.Principal.Name
+		}, ui.RequireRole("admin", "viewer"), ui.DisableUnauthorized())
+
+	rejections := make(chan error, 10)
+	go func() {
+		for err := range form.ErrorChan {
+			if errors.Is(err, http.ErrServerClosed) {
+				return
+			}
+			rejections <- err
+		}
+	}()
+
+	_, err := form.Start()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	getPage := func(token string) string {
+		req, _ := http.NewRequest(http.MethodGet, form.GetUri(), nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Error(err)
+			return ""
+		}
+		body, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		return string(body)
+	}
+
+	restartRegex := regexp.MustCompile(`<button data-gasp-roles="admin" id="gbutton0" ([^>]*)class="gbutton" >Restart</button>`)
+	refreshRegex := regexp.MustCompile(`<button data-gasp-roles="admin,viewer" data-gasp-unauthorized="disable" id="gbutton1" ([^>]*)class="gbutton" >Refresh</button>`)
+
+	page := getPage("viewertoken")
+	if match := restartRegex.FindStringSubmatch(page); match == nil || strings.TrimSpace(match[1]) != "hidden disabled" {
+		t.Errorf("restart button was not hidden for viewer: %s", page)
+	}
+	if match := refreshRegex.FindStringSubmatch(page); match == nil || strings.TrimSpace(match[1]) != "" {
+		t.Errorf("refresh button was not enabled for viewer: %s", page)
+	}
+
+	page = getPage("admintoken")
+	if match := restartRegex.FindStringSubmatch(page); match == nil || strings.TrimSpace(match[1]) != "" {
+		t.Errorf("restart button was not shown for admin: %s", page)
+	}
+
+	header := http.Header{}
+	header.Set("Authorization", "Bearer viewertoken")
+	ws, _, err := websocket.DefaultDialer.Dial("ws://"+socket+"/gaspws"+getPageCsrfQuery(t, form.GetUri(), header), header)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_ = ws.WriteJSON(ui.ClientEvent{View: "test", Id: "gbutton0", Type: "click"})
+	_ = ws.WriteJSON(ui.ClientEvent{View: "test", Id: "gbutton1", Type: "click"})
+
+	select {
+	case err := <-rejections:
+		if !errors.Is(err, ui.ErrUnauthorized) {
+			t.Errorf("unexpected error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("unauthorized event was not reported")
+	}
+
+	select {
+	case name := <-refreshes:
+		if name != "bob" {
+			t.Errorf("invalid principal: %s", name)
+		}
+	case <-time.After(time.Second):
+		t.Error("authorized event was not handled")
+	}
+
+	select {
+	case <-restarts:
+		t.Error("unauthorized event was handled")
+	default:
+	}
+
+	_ = ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""))
+	_ = ws.Close()
+
+	err = form.Stop()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	sink := ui.NewAuditMemorySink(10)
+	handled := make(chan bool, 1)
+
+	form := ui.NewForm(ui.FormOptions{Socket: socket, Path: "test", Server: ui.ServerOptions{
+		Auth: ui.AuthOptions{Authenticator: ui.BearerTokens(map[string]*ui.Principal{"token123": {Name: "alice"}})},
+		Audit: ui.AuditOptions{
+			Sink:        sink,
+			StateFields: []string{"gtextbox*", "gcheckbox0", "pin"},
+			Redact:      []string{"pin"},
+		},
+	}}).
+		AddTextbox("User").
+		AddTextbox("Password", ui.ControlAttribute{Key: "type", Value: "password"}).
+		AddTextbox("PIN", ui.ControlAttribute{Key: "id", Value: "pin"}).
+		AddCheckbox("Remember").
+		AddButton("Login", func(event *ui.ClientEvent) {
+			handled <- true
+		})
+
+	handleErrorChannel(t, form.ErrorChan)
+
+	_, err := form.Start()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	header := http.Header{}
+	header.Set("Authorization", "Bearer token123")
+	ws, _, err := websocket.DefaultDialer.Dial("ws://"+socket+"/gaspws"+getPageCsrfQuery(t, form.GetUri(), header), header)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	state := ui.FormState{
+		Textboxes: []*ui.TextboxState{
+			{ControlState: ui.ControlState{Id: "gtextbox0", Text: "alice"}},
+			{ControlState: ui.ControlState{Id: "gtextbox1", Text: "hunter2"}},
+			{ControlState: ui.ControlState{Id: "pin", Text: "1234"}},
+		},
+		Buttons:    []*ui.ButtonState{{ControlState: ui.ControlState{Id: "gbutton0", Text: "Login"}}},
+		Checkboxes: []*ui.CheckboxState{{ControlState: ui.ControlState{Id: "gcheckbox0"}, IsChecked: true}},
+	}
+	err = ws.WriteJSON(ui.ClientEvent{View: "test", Id: "gbutton0", Type: "click", State: state})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	select {
+	case <-handled:
+	case <-time.After(time.Second):
+		t.Error("event handler was not called")
+	}
+
+	entries := sink.Entries()
+	if len(entries) != 1 {
+		t.Errorf("expected 1 audit entry, got: %d", len(entries))
+		return
+	}
+
+	entry := entries[0]
+	if entry.Principal != "alice" || entry.View != "test" || entry.Element != "gbutton0" || entry.Type != "click" || entry.ClientId == "" || entry.Timestamp.IsZero() {
+		t.Errorf("invalid audit entry: %+v", entry)
+	}
+
+	expectedState := map[string]string{"gtextbox0": "alice", "gtextbox1": "[REDACTED]", "pin": "[REDACTED]", "gcheckbox0": "true"}
+	if fmt.Sprint(entry.State) != fmt.Sprint(expectedState) {
+		t.Errorf("invalid audit state: %v", entry.State)
+	}
+
+	_ = ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""))
+	_ = ws.Close()
+
+	err = form.Stop()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	auditFile := filepath.Join(t.TempDir(), "audit.jsonl")
+	fileSink, err := ui.NewAuditFileSink(auditFile)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	_ = fileSink.Record(&entry)
+	_ = fileSink.Record(&ui.AuditEntry{View: "test", Element: "gbutton1", Type: "click"})
+	_ = fileSink.Close()
+
+	content, _ := os.ReadFile(auditFile)
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	recorded := ui.AuditEntry{}
+	if len(lines) != 2 || json.Unmarshal([]byte(lines[0]), &recorded) != nil || recorded.Principal != "alice" || recorded.State["gtextbox1"] != "[REDACTED]" {
+		t.Errorf("invalid audit file: %s", content)
+	}
+}
+
+func TestResources(t *testing.T) {
+	server := getNewServer(t)
+	if server == nil {
+		return
+	}
+
+	handleErrorChannel(t, server.ErrorChan)
+
+	err := server.AddResources("resources", ".go", ".sh", ".crt", ".key")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = server.Start()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	resp, err := getResponse("http://" + socket + "/css/test.css")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if !strings.HasPrefix(resp, ".testClass{}") {
+		t.Errorf("invalid response received: %s", resp)
+		return
+	}
+
+	resp, err = getResponse("http://" + socket + "/certs/test-ca.key")
+	if err == nil {
+		t.Error("expected not to be able to download test-ca.key")
+		return
+	}
+
+	err = server.Stop()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+}
+
+func TestAssets(t *testing.T) {
+	server := getNewServer(t)
+	if server == nil {
+		return
+	}
+
+	handleErrorChannel(t, server.ErrorChan)
+
+	err := server.AddView("test", "<html><head><!--gasp_css--></head><body data-gasp-init><!--gasp_js--></body></html>")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	server.AddEventHandler("test", "button1", "click", func(event *ui.ClientEvent) {})
+
+	err = server.Start()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	resp, err := getResponse("http://" + socket + "/test")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if strings.Contains(resp, resources.GaspScript) || strings.Contains(resp, resources.GaspStyle) {
+		t.Error("expected the assets not to be inlined")
+	}
+
+	configRegex := regexp.MustCompile(`<script type="application/json" id="gasp-config">\{"server_socket":"` + regexp.QuoteMeta(socket) + `","use_tls":false,"csrf_token":"[^"]+","handlers":\[\{"id":"button1","type":"click"\}\]\}</script>`)
+	if !configRegex.MatchString(resp) {
+		t.Errorf("invalid config in response: %s", resp)
+	}
+
+	scriptUrl := regexp.MustCompile(`<script src="(/gasp/gasp\.[0-9a-f]+\.js)"></script>`).FindStringSubmatch(resp)
+	styleUrl := regexp.MustCompile(`<link rel="stylesheet" href="(/gasp/gasp\.[0-9a-f]+\.css)">`).FindStringSubmatch(resp)
+	if scriptUrl == nil || styleUrl == nil {
+		t.Errorf("asset links not found in response: %s", resp)
+		return
+	}
+
+	for path, content := range map[string]string{scriptUrl[1]: resources.GaspScript, styleUrl[1]: resources.GaspStyle} {
+		resp, err := http.Get("http://" + socket + path)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if resp.StatusCode != http.StatusOK || string(body) != content {
+			t.Errorf("invalid response received for %s: %d", path, resp.StatusCode)
+		}
+
+		if !strings.Contains(resp.Header.Get("Cache-Control"), "immutable") {
+			t.Errorf("invalid Cache-Control header for %s: %s", path, resp.Header.Get("Cache-Control"))
+		}
+
+		etag := resp.Header.Get("ETag")
+		if etag == "" {
+			t.Errorf("missing ETag header for %s", path)
+		}
+
+		req, _ := http.NewRequest(http.MethodGet, "http://"+socket+path, nil)
+		req.Header.Set("If-None-Match", etag)
+		resp, err = http.DefaultClient.Do(req)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusNotModified {
+			t.Errorf("expected %s to not be modified, got %d", path, resp.StatusCode)
+		}
+	}
+
+	err = server.AddView("gasp/test", "")
+	if err == nil {
+		t.Error("expected the /gasp/ prefix to be reserved")
+	}
+
+	err = server.Stop()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+}
+
+func TestResourcesFS(t *testing.T) {
+	server := getNewServer(t)
+	if server == nil {
+		return
+	}
+
+	handleErrorChannel(t, server.ErrorChan)
+
+	fsys := fstest.MapFS{
+		"js/app.js":        {Data: []byte("console.log('app');")},
+		"js/app.js.map":    {Data: []byte("{}")},
+		"views/index.html": {Data: []byte("<p><!--now:2006--></p>")},
+	}
+
+	err := server.AddResourcesFS("static", fsys, ".map")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = server.AddViewFS("index", fsys, "views/index.html")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = server.AddViewFS("missing", fsys, "views/missing.html")
+	if err == nil {
+		t.Error("expected missing view file to be rejected")
+	}
+
+	err = server.Start()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	resp, err := getResponse("http://" + socket + "/static/js/app.js")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if resp != "console.log('app');" {
+		t.Errorf("invalid response received: %s", resp)
+	}
+
+	_, err = getResponse("http://" + socket + "/static/js/app.js.map")
+	if err == nil {
+		t.Error("expected not to be able to download app.js.map")
+	}
+
+	resp, err = getResponse("http://" + socket + "/index")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if resp != fmt.Sprintf("<p>%d</p>", time.Now().UTC().Year()) {
+		t.Errorf("invalid response received: %s", resp)
+	}
+
+	err = server.Stop()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+}
+
+func TestResourceServing(t *testing.T) {
+	server := getNewServer(t)
+	if server == nil {
+		return
+	}
+
+	handleErrorChannel(t, server.ErrorChan)
+
+	dir := t.TempDir()
+	gzipped := bytes.Buffer{}
+	gzipWriter := gzip.NewWriter(&gzipped)
+	_, _ = gzipWriter.Write([]byte(".site{}"))
+	_ = gzipWriter.Close()
+
+	files := map[string][]byte{
+		"index.html":      []byte("<p>index</p>"),
+		"css/site.css":    []byte(".site{}"),
+		"css/site.css.gz": gzipped.Bytes(),
+		"data/large.bin":  []byte("0123456789abcdefghijklmnopqrstuvwxyz"),
+	}
+	for name, content := range files {
+		_ = os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755)
+		err := os.WriteFile(filepath.Join(dir, name), content, 0644)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	err := server.AddResourcesWithOptions(dir, ui.ResourceOptions{
+		IndexFiles:      []string{"index.html"},
+		CacheControl:    "public, max-age=60",
+		StreamThreshold: 16,
+		NotFoundHandler: func(rw http.ResponseWriter, req *http.Request) {
+			rw.WriteHeader(http.StatusNotFound)
+			_, _ = rw.Write([]byte("missing"))
+		},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = server.Start()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	get := func(path string, headers map[string]string) (*http.Response, string) {
+		req, _ := http.NewRequest(http.MethodGet, "http://"+socket+path, nil)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Error(err)
+			return nil, ""
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp, string(body)
+	}
+
+	resp, body := get("/css/site.css", map[string]string{"Accept-Encoding": "identity"})
+	if resp == nil || resp.StatusCode != http.StatusOK || body != ".site{}" || resp.Header.Get("Content-Type") != "text/css; charset=utf-8" ||
+		resp.Header.Get("Cache-Control") != "public, max-age=60" || resp.Header.Get("Vary") != "Accept-Encoding" {
+		t.Errorf("invalid uncompressed response received: %v %s", resp, body)
+		return
+	}
+
+	resp, _ = get("/css/site.css", map[string]string{"Accept-Encoding": "identity", "If-None-Match": resp.Header.Get("ETag")})
+	if resp == nil || resp.StatusCode != http.StatusNotModified {
+		t.Errorf("expected not modified response, got: %v", resp)
+	}
+
+	resp, body = get("/css/site.css", map[string]string{"Accept-Encoding": "gzip, br;q=0"})
+	if resp == nil || resp.Header.Get("Content-Encoding") != "gzip" || body != gzipped.String() || resp.Header.Get("Content-Type") != "text/css; charset=utf-8" {
+		t.Errorf("invalid compressed response received: %v", resp)
+	}
+
+	resp, body = get("/data/large.bin", map[string]string{"Range": "bytes=10-15"})
+	if resp == nil || resp.StatusCode != http.StatusPartialContent || body != "abcdef" || resp.Header.Get("ETag") == "" {
+		t.Errorf("invalid range response received: %v %s", resp, body)
+	}
+
+	err = os.WriteFile(filepath.Join(dir, "data/large.bin"), []byte("the file has changed on disk"), 0644)
+	if err != nil {
+		t.Error(err)
+	}
+
+	resp, body = get("/data/large.bin", nil)
+	if resp == nil || body != "the file has changed on disk" {
+		t.Errorf("expected large file to be streamed from disk: %s", body)
+	}
+
+	resp, body = get("/", nil)
+	if resp == nil || resp.StatusCode != http.StatusOK || body != "<p>index</p>" {
+		t.Errorf("invalid index response received: %v %s", resp, body)
+	}
+
+	resp, body = get("/css/missing.css", nil)
+	if resp == nil || resp.StatusCode != http.StatusNotFound || body != "missing" {
+		t.Errorf("invalid not found response received: %v %s", resp, body)
+	}
+
+	err = server.Stop()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+}
+
+func TestDevMode(t *testing.T) {
+	server, err := ui.NewServerWithOptions(socket, ui.ServerOptions{DevMode: true, WatchInterval: 50 * time.Millisecond})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	handleErrorChannel(t, server.ErrorChan)
+
+	dir := t.TempDir()
+	_ = os.Mkdir(filepath.Join(dir, "static"), 0755)
+	_ = os.WriteFile(filepath.Join(dir, "index.html"), []byte("<p>before</p>"), 0644)
+	_ = os.WriteFile(filepath.Join(dir, "static", "site.css"), []byte(".before{}"), 0644)
+
+	err = server.AddViewFS("test", os.DirFS(dir), "index.html")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = server.AddResourcesFS("static", os.DirFS(filepath.Join(dir, "static")))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = server.Start()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws://"+socket+"/gaspws"+getCsrfQuery(server), nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	info := ui.ServerEvent{}
+	err = ws.ReadJSON(&info)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	readReload := func() *ui.ServerEvent {
+		reload := ui.ServerEvent{}
+		_ = ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+		err := ws.ReadJSON(&reload)
+		if err != nil {
+			t.Error(err)
+			return nil
+		}
+		if reload.Type != "reload" {
+			t.Errorf("expected reload event, got: %s", reload.Type)
+			return nil
+		}
+		return &reload
+	}
+
+	_ = os.WriteFile(filepath.Join(dir, "static", "site.css"), []byte(".after{}"), 0644)
+	reload := readReload()
+	if reload != nil && (reload.Data["kind"] != "css" || reload.Data["path"] != "/static/site.css") {
+		t.Errorf("unexpected reload event: %v", reload.Data)
+	}
+
+	resp, err := getResponse("http://" + socket + "/static/site.css")
+	if err != nil || resp != ".after{}" {
+		t.Errorf("expected changed stylesheet, got: %s %v", resp, err)
+	}
+
+	_ = os.WriteFile(filepath.Join(dir, "index.html"), []byte("<p>after!</p>"), 0644)
+	reload = readReload()
+	if reload != nil && reload.Data["kind"] != "page" {
+		t.Errorf("unexpected reload event: %v", reload.Data)
+	}
+
+	resp, err = getResponse("http://" + socket + "/test")
+	if err != nil || resp != "<p>after!</p>" {
+		t.Errorf("expected changed view, got: %s %v", resp, err)
+	}
+
+	_ = ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""))
+	_ = ws.Close()
+
+	err = server.Stop()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+}
+
+func TestVariables1(t *testing.T) {
+	server := getNewServer(t)
+	if server == nil {
+		return
+	}
+
+	handleErrorChannel(t, server.ErrorChan)
+
+	hostname, _ := os.Hostname()
+
+	err := server.AddView("", "<!--hostname-->")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = server.AddVariableSetter("hostname", func(req *http.Request) string {
+		return hostname
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = server.Start()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	resp, err := getResponse("http://" + socket + "/")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if resp != hostname {
+		t.Errorf("invalid response received: %s", resp)
+		return
+	}
+
+	err = server.Stop()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+}
+
+// NOTE THIS TEST REQUIRES MANUAL INTERVENTION!
+func TestVariables2(t *testing.T) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	buttonClicked := false
+
+	form := ui.NewForm().
+		AddVariableSetter("hostname", func(req *http.Request) string {
+			return hostname
+		}).
+		AddVariableLabel("hostname").
+		AddButton("Run Test", func(event *ui.ClientEvent) {
+			t.Log("button clicked")
+
+			labelText := event.State.Labels[0].Text
+			if labelText != hostname {
+				t.Error(fmt.Errorf("label text '%s' does not match expected value ('%s')", labelText, hostname))
+				return
+			}
+			buttonClicked = true
+		})
+
+	handleErrorChannel(t, form.ErrorChan)
+
+	_, err = form.Start()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	t.Logf("ACCESS THE UI WITHIN 10 SECONDS TO COMPLETE THE TEST: http://%s", socket)
+	time.Sleep(10 * time.Second)
+
+	err = form.Stop()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if !buttonClicked {
+		t.Error("button was not clicked or a failure occurred")
+		return
+	}
+}
+
+func TestTLSConfig(t *testing.T) {
+	caCert, caKey, _, _ := newTestCertificate(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+	_, _, serverCertPem, serverKeyPem := newTestCertificate(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "localhost"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, caCert, caKey)
+	_, _, clientCertPem, clientKeyPem := newTestCertificate(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "alice", OrganizationalUnit: []string{"admin"}},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, caCert, caKey)
+
+	certDir := t.TempDir()
+	certFile := filepath.Join(certDir, "server.crt")
+	keyFile := filepath.Join(certDir, "server.key")
+	_ = os.WriteFile(certFile, serverCertPem, 0600)
+	_ = os.WriteFile(keyFile, serverKeyPem, 0600)
+
+	reloader, err := ui.NewCertificateReloader(certFile, keyFile)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	server, err := ui.NewServerWithOptions(socket, ui.ServerOptions{Auth: ui.AuthOptions{Authenticator: ui.ClientCertificateAuth()}})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	handleErrorChannel(t, server.ErrorChan)
+
+	err = server.AddVariableSetter("subject", func(req *http.Request) string {
+		return ui.GetClientCertificate(req).Subject.CommonName
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = server.AddView("whoami", "<!--subject-->")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	principals := make(chan string, 1)
+	server.AddEventHandler("whoami", "gbutton0", "click", func(event *ui.ClientEvent) {
+		principals <- event.ClientCertificate.Subject.CommonName + " " + strings.Join(event.Principal.Roles, ",")
+	})
+
+	caPool := x509.NewCertPool()
+	caPool.AddCert(caCert)
+
+	err = server.StartWithTLSConfig(&tls.Config{
+		GetCertificate: reloader.GetCertificate,
+		ClientAuth:     tls.VerifyClientCertIfGiven,
+		ClientCAs:      caPool,
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	clientCert, err := tls.X509KeyPair(clientCertPem, clientKeyPem)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	clientTlsConfig := &tls.Config{RootCAs: caPool, Certificates: []tls.Certificate{clientCert}}
+	client := http.Client{Transport: &http.Transport{TLSClientConfig: clientTlsConfig}}
+	resp, err := client.Get("https://" + socket + "/whoami")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	body, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || string(body) != "alice" {
+		t.Errorf("invalid response for client certificate: %d %s", resp.StatusCode, body)
+	}
+
+	anonymousClient := http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: caPool}}}
+	resp, err = anonymousClient.Get("https://" + socket + "/whoami")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	_ = resp.Body.Close()
+
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected request without a client certificate to be rejected, got: %d", resp.StatusCode)
+	}
+
+	dialer := websocket.Dialer{TLSClientConfig: clientTlsConfig}
+	ws, _, err := dialer.Dial("wss://"+socket+"/gaspws"+getCsrfQuery(server), nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_ = ws.WriteJSON(ui.ClientEvent{View: "whoami", Id: "gbutton0", Type: "click"})
+
+	select {
+	case principal := <-principals:
+		if principal != "alice admin" {
+			t.Errorf("invalid event client certificate: %s", principal)
+		}
+	case <-time.After(time.Second):
+		t.Error("event handler was not called")
+	}
+
+	_ = ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""))
+	_ = ws.Close()
+
+	_, _, renewedCertPem, renewedKeyPem := newTestCertificate(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "renewed"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, caCert, caKey)
+	_ = os.WriteFile(certFile, renewedCertPem, 0600)
+	_ = os.WriteFile(keyFile, renewedKeyPem, 0600)
+	later := time.Now().Add(time.Minute)
+	_ = os.Chtimes(certFile, later, later)
+	_ = os.Chtimes(keyFile, later, later)
+	time.Sleep(1100 * time.Millisecond)
+
+	conn, err := tls.Dial("tcp", socket, &tls.Config{RootCAs: caPool})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if subject := conn.ConnectionState().PeerCertificates[0].Subject.CommonName; subject != "renewed" {
+		t.Errorf("certificate was not reloaded: %s", subject)
+	}
+	_ = conn.Close()
+
+	err = server.Stop()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+}
+
+func TestListeners(t *testing.T) {
+	for _, valid := range []string{"127.0.0.1:8800", "localhost:8800", "gasp.example.com:443", "[::1]:8800", "[fe80::1%eth0]:8800", ":8800", "unix:/tmp/gasp.sock"} {
+		if err := ui.ValidateSocket(valid); err != nil {
+			t.Errorf("expected socket '%s' to be valid: %v", valid, err)
+		}
+	}
+
+	for _, invalid := range []string{"8800", "localhost", "::1:8800", "localhost:99999", "bad_host!:8800", "unix:"} {
+		if ui.ValidateSocket(invalid) == nil {
+			t.Errorf("expected socket '%s' to be invalid", invalid)
+		}
+	}
+
+	getSocketVariable := func(server *ui.Server, client *http.Client) string {
+		resp, err := client.Get(server.GetUri("test"))
+		if err != nil {
+			t.Error(err)
+			return ""
+		}
+		body, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		return string(body)
+	}
+
+	startServer := func(socket string, options ui.ServerOptions) *ui.Server {
+		server, err := ui.NewServerWithOptions(socket, options)
+		if err != nil {
+			t.Error(err)
+			return nil
+		}
+		handleErrorChannel(t, server.ErrorChan)
+
+		err = server.AddView("test", "<!--server_socket-->")
+		if err == nil {
+			err = server.Start()
+		}
+		if err != nil {
+			t.Error(err)
+			return nil
+		}
+		return server
+	}
+
+	server := startServer(":0", ui.ServerOptions{})
+	if server == nil {
+		return
+	}
+	if uri := server.GetUri("test"); !strings.HasPrefix(uri, "http://localhost:") || strings.HasPrefix(uri, "http://localhost:0/") {
+		t.Errorf("invalid URI for all-interfaces listener: %s", uri)
+	}
+	clientSocket := getSocketVariable(server, http.DefaultClient)
+	if clientSocket != "" {
+		t.Errorf("expected no client socket for all-interfaces listener, got %s", clientSocket)
+	}
+	_ = server.Stop()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	server = startServer("", ui.ServerOptions{Listener: listener})
+	if server == nil {
+		return
+	}
+	if clientSocket = getSocketVariable(server, http.DefaultClient); clientSocket != listener.Addr().String() {
+		t.Errorf("invalid client socket for external listener: %s", clientSocket)
+	}
+	_ = server.Stop()
+
+	if probe, err := net.Listen("tcp", "[::1]:0"); err == nil {
+		_ = probe.Close()
+		server = startServer("[::1]:8800", ui.ServerOptions{})
+		if server == nil {
+			return
+		}
+		if clientSocket = getSocketVariable(server, http.DefaultClient); clientSocket != "[::1]:8800" {
+			t.Errorf("invalid client socket for IPv6 listener: %s", clientSocket)
+		}
+		_ = server.Stop()
+	}
+
+	socketPath := filepath.Join(t.TempDir(), "gasp.sock")
+	server = startServer("unix:"+socketPath, ui.ServerOptions{})
+	if server == nil {
+		return
+	}
+
+	if uri := server.GetUri("test"); !strings.HasPrefix(uri, "http+unix://") || !strings.HasSuffix(uri, "/test") {
+		t.Errorf("invalid URI for Unix socket: %s", uri)
+	}
+
+	unixClient := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return net.Dial("unix", socketPath)
+		},
+	}}
+	resp, err := unixClient.Get("http://localhost/test")
+	if err != nil {
+		t.Error(err)
+	} else {
+		body, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || string(body) != "" {
+			t.Errorf("invalid response over Unix socket: %d %s", resp.StatusCode, body)
+		}
+	}
+
+	_ = server.Stop()
+}
+
+func TestAutoTLS(t *testing.T) {
+	certDir := t.TempDir()
+
+	server, err := ui.NewServerWithOptions(socket, ui.ServerOptions{DevCertificateDir: certDir})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	handleErrorChannel(t, server.ErrorChan)
+
+	err = server.AddView("test", "secure")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = server.StartWithAutoTLS()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	cert, err := ui.GenerateDevCertificateInDir(certDir, "127.0.0.1")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	client := http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: cert.CertPool()}}}
+	resp, err := client.Get("https://" + socket + "/test")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	body, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+
+	if string(body) != "secure" {
+		t.Errorf("invalid response received: %s", body)
+	}
+
+	if resp.TLS == nil || !resp.TLS.PeerCertificates[0].Equal(cert.Certificate.Leaf) {
+		t.Error("cached certificate was not used")
+	}
+
+	err = server.Stop()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	otherCert, err := ui.GenerateDevCertificateInDir(certDir, "gasp.test")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if !otherCert.CaCertificate.Equal(cert.CaCertificate) || otherCert.CertFile == cert.CertFile {
+		t.Error("expected a new certificate signed by the cached CA")
+	}
+
+	err = otherCert.Certificate.Leaf.VerifyHostname("gasp.test")
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+// NOTE THIS TEST REQUIRES MANUAL INTERVENTION!
+func TestTLS(t *testing.T) {
+	buttonClicked := false
+
+	form := ui.NewForm().
+		AddButton("Run Test", func(event *ui.ClientEvent) {
+			t.Log("button clicked")
+			buttonClicked = true
+		})
+
+	handleErrorChannel(t, form.ErrorChan)
+
+	err := form.StartWithTLS("resources/certs/test-server.crt", "resources/certs/test-server.key")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	t.Logf("ACCESS THE UI WITHIN 10 SECONDS TO COMPLETE THE TEST: %s", form.GetUri())
+	time.Sleep(10 * time.Second)
+
+	err = form.Stop()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if !buttonClicked {
+		t.Error("button was not clicked or a failure occurred")
+		return
+	}
+}
+
+func TestEventRouter(t *testing.T) {
+	server := getNewServer(t)
+	if server == nil {
+		return
+	}
+
+	handleErrorChannel(t, server.ErrorChan)
+
+	err := server.AddView("devices/list", "<!--gasp_js-->")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	calls := make(chan string, 10)
+
+	server.AddEventHandler("*", "*", "click", func(event *ui.ClientEvent) {
+		calls <- "any"
+	})
+
+	err = server.AddEventRoute(ui.EventRoute{
+		View: "devices/*",
+		Id:   "re:^gbutton[0-9]+$",
+		Type: "click",
+		Handler: func(event *ui.ClientEvent) {
+			calls <- "button"
+		},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = server.AddEventRoute(ui.EventRoute{
+		Type:     "click",
+		Priority: 10,
+		Handler: func(event *ui.ClientEvent) {
+			calls <- "first"
+			if event.Data["stop"] == true {
+				event.StopPropagation()
+			}
+		},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	server.UseEventMiddleware(ui.AuthorizeEvents(func(event *ui.ClientEvent) bool {
+		return event.Data["deny"] != true
+	}))
+	server.SetEventWorkers(2, 10)
+
+	err = server.Start()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	resp, err := getResponse("http://" + socket + "/devices/list")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if !strings.Contains(resp, `"handlers":[{"id":"*","type":"click"},{"id":"","type":"click","pattern":"^gbutton[0-9]+$"}]`) {
+		t.Errorf("expected the pattern routes to be sent to the client: %s", resp)
+	}
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws://"+socket+"/gaspws"+getCsrfQuery(server), nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	expectCalls := func(expected ...string) {
+		for _, e := range expected {
+			select {
+			case c := <-calls:
+				if c != e {
+					t.Errorf("expected handler '%s' to be called, got '%s'", e, c)
+				}
+			case <-time.After(time.Second):
+				t.Errorf("handler '%s' was not called", e)
+			}
+		}
+		select {
+		case c := <-calls:
+			t.Errorf("unexpected call to handler '%s'", c)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	sendEvent := func(data map[string]interface{}) {
+		err := ws.WriteJSON(ui.ClientEvent{View: "devices/list", Id: "gbutton1", Type: "click", Data: data})
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	sendEvent(nil)
+	expectCalls("first", "button", "any")
+
+	sendEvent(map[string]interface{}{"stop": true})
+	expectCalls("first")
+
+	sendEvent(map[string]interface{}{"deny": true})
+	expectCalls()
+
+	err = ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""))
+	if err != nil {
+		t.Error(err)
+	}
+	_ = ws.Close()
+
+	err = server.Stop()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+}
+
+func TestHandlerPanicRecovery(t *testing.T) {
+	server, err := ui.NewServerWithOptions(socket, ui.ServerOptions{NotifyClientOnHandlerError: true})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	handlerErrChan := make(chan *ui.HandlerError, 1)
+	go func() {
+		for {
+			err := <-server.ErrorChan
+			var handlerErr *ui.HandlerError
+			if errors.As(err, &handlerErr) {
+				handlerErrChan <- handlerErr
+			}
+			if errors.Is(err, http.ErrServerClosed) {
+				return
+			}
+		}
+	}()
+
+	secondHandlerCalled := make(chan bool, 1)
+	server.AddEventHandler("test", "gbutton0", "click", func(event *ui.ClientEvent) {
+		panic("something went wrong")
+	})
+	server.AddEventHandler("*", "gbutton0", "click", func(event *ui.ClientEvent) {
+		secondHandlerCalled <- true
+	})
+
+	err = server.Start()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws://"+socket+"/gaspws"+getCsrfQuery(server), nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	info := ui.ServerEvent{}
+	err = ws.ReadJSON(&info)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	clientId, _ := info.Data["client_id"].(string)
+	if info.Type != "ws_info" || clientId == "" {
+		t.Errorf("expected ws_info event with a client ID, got: %v", info)
+		return
+	}
+
+	err = ws.WriteJSON(ui.ClientEvent{View: "test", Id: "gbutton0", Type: "click"})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	select {
+	case handlerErr := <-handlerErrChan:
+		if handlerErr.ClientId != clientId || handlerErr.ElementId != "gbutton0" || handlerErr.View != "test" || len(handlerErr.Stack) == 0 {
+			t.Errorf("unexpected handler error: %v", handlerErr)
+		}
+	case <-time.After(time.Second):
+		t.Error("handler error was not reported")
+	}
+
+	select {
+	case <-secondHandlerCalled:
+	case <-time.After(time.Second):
+		t.Error("second handler was not called after the first one panicked")
+	}
+
+	notification := ui.ServerEvent{}
+	_ = ws.SetReadDeadline(time.Now().Add(time.Second))
+	err = ws.ReadJSON(&notification)
+	if err != nil {
+		t.Error(err)
+	} else if notification.Type != "handler_error" {
+		t.Errorf("expected handler_error event, got: %s", notification.Type)
+	}
+
+	_ = ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""))
+	_ = ws.Close()
+
+	err = server.Stop()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+}
+
+func TestErrorHandling(t *testing.T) {
+	onErrorChan := make(chan *ui.Error, 10)
+	logBuffer := &strings.Builder{}
+
+	server, err := ui.NewServerWithOptions(socket, ui.ServerOptions{
+		OnError: func(err *ui.Error) {
+			onErrorChan <- err
+		},
+		Logger: slog.New(slog.NewTextHandler(logBuffer, nil)),
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = server.Start()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws://"+socket+"/gaspws"+getCsrfQuery(server), nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = ws.WriteMessage(websocket.TextMessage, []byte("not json"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	select {
+	case gaspErr := <-onErrorChan:
+		if gaspErr.Source != ui.ErrorSourceDecode || gaspErr.ClientId == "" {
+			t.Errorf("unexpected error: %v", gaspErr)
+		}
+	case <-time.After(time.Second):
+		t.Error("decode error was not reported")
+	}
+
+	select {
+	case chanErr := <-server.ErrorChan:
+		var gaspErr *ui.Error
+		if !errors.As(chanErr, &gaspErr) || gaspErr.Source != ui.ErrorSourceDecode {
+			t.Errorf("unexpected error: %v", chanErr)
+		}
+	default:
+		t.Error("decode error was not sent to ErrorChan")
+	}
+
+	if !strings.Contains(logBuffer.String(), "decode error") {
+		t.Errorf("decode error was not logged: %s", logBuffer.String())
+	}
+
+	ws2, _, err := websocket.DefaultDialer.Dial("ws://"+socket+"/gaspws"+getCsrfQuery(server), nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	_ = ws2.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""))
+	_ = ws2.Close()
+
+	err = server.Stop()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	select {
+	case gaspErr := <-onErrorChan:
+		t.Errorf("benign error was not filtered out: %v", gaspErr)
+	case <-time.After(500 * time.Millisecond):
+	}
+}
+
+func TestOutgoingEventCoalescing(t *testing.T) {
+	server, err := ui.NewServerWithOptions(socket, ui.ServerOptions{QueuePolicy: ui.QueueBlock})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	handleErrorChannel(t, server.ErrorChan)
+
+	err = server.Start()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws://"+socket+"/gaspws"+getCsrfQuery(server), nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	info := ui.ServerEvent{}
+	err = ws.ReadJSON(&info)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	valueCount := 5000
+	go func() {
+		for i := 0; i < valueCount; i++ {
+			state := ui.LineChartState{}
+			state.Id = "glinechart0"
+			state.Lines = []*ui.LineState{{Name: "line0", NewValues: []float64{float64(i)}}}
+			server.SendEvent(&ui.ServerEvent{
+				Type: "linechart_update",
+				Data: map[string]interface{}{"state": &state, "properties": []string{"values"}},
+			})
+		}
+	}()
+
+	received := make([]float64, 0)
+	messageCount := 0
+	_ = ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for len(received) < valueCount {
+		_, msg, err := ws.ReadMessage()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		messageCount++
+
+		events := make([]ui.ServerEvent, 0)
+		if msg[0] == '[' {
+			err = json.Unmarshal(msg, &events)
+		} else {
+			evt := ui.ServerEvent{}
+			err = json.Unmarshal(msg, &evt)
+			events = append(events, evt)
+		}
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		for _, evt := range events {
+			state := evt.Data["state"].(map[string]interface{})
+			lines := state["lines"].([]interface{})
+			for _, v := range lines[0].(map[string]interface{})["new_values"].([]interface{}) {
+				received = append(received, v.(float64))
+			}
+		}
+	}
+
+	for i, v := range received {
+		if v != float64(i) {
+			t.Errorf("value %d is out of order or missing: %f", i, v)
+			break
+		}
+	}
+
+	stats := server.QueueStats()
+	if stats.Dropped != 0 {
+		t.Errorf("expected no events to be dropped, got %d", stats.Dropped)
+	}
+
+	if messageCount >= valueCount || stats.Coalesced == 0 {
+		t.Errorf("expected updates to be coalesced (messages: %d, stats: %+v)", messageCount, stats)
+	}
+
+	_ = ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""))
+	_ = ws.Close()
+
+	err = server.Stop()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+}
+
+func TestOutgoingEventCoalescingOrder(t *testing.T) {
+	server, err := ui.NewServerWithOptions(socket, ui.ServerOptions{QueuePolicy: ui.QueueBlock})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	handleErrorChannel(t, server.ErrorChan)
+
+	err = server.Start()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws://"+socket+"/gaspws"+getCsrfQuery(server), nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	info := ui.ServerEvent{}
+	err = ws.ReadJSON(&info)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	valueCount := 6002
+	padding := strings.Repeat("x", 16*1024)
+	go func() {
+		for i := 0; i < valueCount; i++ {
+			text := strconv.Itoa(i)
+			switch (i / 2) % 3 {
+			case 0:
+				server.SendEvent(&ui.ServerEvent{
+					Type: "form_update",
+					Text: padding,
+					Data: map[string]interface{}{"state": &ui.FormState{Textboxes: []*ui.TextboxState{{ControlState: ui.ControlState{Id: "gtextbox0", Text: text}}}}},
+				})
+			case 1:
+				server.SendEvent(&ui.ServerEvent{
+					Type: "textbox_update",
+					Text: padding,
+					Data: map[string]interface{}{"state": &ui.TextboxState{ControlState: ui.ControlState{Id: "gtextbox0", Text: text}}, "properties": []string{"text"}},
+				})
+			case 2:
+				server.SendEvent(&ui.ServerEvent{
+					Type: "textbox_update",
+					Text: padding,
+					Data: map[string]interface{}{"state": &ui.TextboxState{ControlState: ui.ControlState{Id: "gtextbox0", Text: text, IsEnabled: true}}, "properties": []string{"text", "is_enabled"}},
+				})
+			}
+		}
+	}()
+
+	time.Sleep(300 * time.Millisecond)
+
+	last := -1
+	done := false
+	_ = ws.SetReadDeadline(time.Now().Add(10 * time.Second))
+	for !done {
+		_, msg, err := ws.ReadMessage()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		events := make([]ui.ServerEvent, 0)
+		if msg[0] == '[' {
+			err = json.Unmarshal(msg, &events)
+		} else {
+			evt := ui.ServerEvent{}
+			err = json.Unmarshal(msg, &evt)
+			events = append(events, evt)
+		}
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		for _, evt := range events {
+			state := evt.Data["state"].(map[string]interface{})
+			if evt.Type == "form_update" {
+				state = state["textboxes"].([]interface{})[0].(map[string]interface{})
+			}
+
+			value, err := strconv.Atoi(state["text"].(string))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			if value < last {
+				t.Errorf("%s with value %d was received after value %d", evt.Type, value, last)
+				return
+			}
+			last = value
+
+			if value == valueCount-1 {
+				done = true
+			}
+		}
+	}
+
+	if server.QueueStats().Coalesced == 0 {
+		t.Error("expected updates to be coalesced")
+	}
+
+	_ = ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""))
+	_ = ws.Close()
+
+	err = server.Stop()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+}
+
+func TestBinaryMessages(t *testing.T) {
+	server, err := ui.NewServerWithOptions(socket, ui.ServerOptions{
+		MessageFormat:     ui.MessageFormatBinary,
+		EnableCompression: true,
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	handleErrorChannel(t, server.ErrorChan)
+
+	err = server.Start()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	dialer := websocket.Dialer{EnableCompression: true}
+	ws, resp, err := dialer.Dial("ws://"+socket+"/gaspws"+getCsrfQuery(server), nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if !strings.Contains(resp.Header.Get("Sec-Websocket-Extensions"), "permessage-deflate") {
+		t.Error("permessage-deflate was not negotiated")
+	}
+
+	// version byte, big-endian header length, JSON header and then the attachments
+	readBinaryEvent := func() (map[string]interface{}, [][]byte) {
+		msgType, msg, err := ws.ReadMessage()
+		if err != nil {
+			t.Error(err)
+			return nil, nil
+		}
+		if msgType != websocket.BinaryMessage || msg[0] != 1 {
+			t.Errorf("unexpected message: %d %v", msgType, msg)
+			return nil, nil
+		}
+
+		headerLength := binary.BigEndian.Uint32(msg[1:5])
+		header := struct {
+			Payload     map[string]interface{} `json:"payload"`
+			Attachments []struct {
+				Kind   string `json:"kind"`
+				Length int    `json:"length"`
+			} `json:"attachments"`
+		}{}
+		err = json.Unmarshal(msg[5:5+headerLength], &header)
+		if err != nil {
+			t.Error(err)
+			return nil, nil
+		}
+
+		offset := 5 + int(headerLength)
+		attachments := make([][]byte, 0)
+		for _, attachment := range header.Attachments {
+			size := attachment.Length
+			if attachment.Kind == "f64" {
+				size *= 8
+			}
+			attachments = append(attachments, msg[offset:offset+size])
+			offset += size
+		}
+		return header.Payload, attachments
+	}
+
+	info, _ := readBinaryEvent()
+	if info["type"] != "ws_info" {
+		t.Errorf("expected ws_info event, got: %v", info)
+		return
+	}
+
+	packetState := ui.PacketInspectorState{}
+	packetState.Id = "gpacketinspector0"
+	packetState.Packet = base64.StdEncoding.EncodeToString([]byte{1, 2, 3, 133})
+	server.SendEvent(&ui.ServerEvent{
+		Type: "packetinspector_update",
+		Data: map[string]interface{}{"state": &packetState, "properties": []string{"packet"}},
+	})
+
+	payload, attachments := readBinaryEvent()
+	if payload["type"] != "packetinspector_update" || len(attachments) != 1 || !bytes.Equal(attachments[0], []byte{1, 2, 3, 133}) {
+		t.Errorf("unexpected packet inspector update: %v %v", payload, attachments)
+	}
+
+	lineState := ui.LineChartState{}
+	lineState.Id = "glinechart0"
+	lineState.Lines = []*ui.LineState{{Name: "line0", NewValues: []float64{1.5, -2.25}}}
+	server.SendEvent(&ui.ServerEvent{
+		Type: "linechart_update",
+		Data: map[string]interface{}{"state": &lineState, "properties": []string{"values"}},
+	})
+
+	payload, attachments = readBinaryEvent()
+	if payload["type"] != "linechart_update" || len(attachments) != 1 || len(attachments[0]) != 16 {
+		t.Errorf("unexpected line chart update: %v %v", payload, attachments)
+	} else {
+		first := math.Float64frombits(binary.LittleEndian.Uint64(attachments[0][0:8]))
+		second := math.Float64frombits(binary.LittleEndian.Uint64(attachments[0][8:16]))
+		if first != 1.5 || second != -2.25 {
+			t.Errorf("unexpected line chart values: %f %f", first, second)
+		}
+	}
+
+	_ = ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""))
+	_ = ws.Close()
+
+	err = server.Stop()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+}
+
+func TestCompiledView(t *testing.T) {
+	view := ui.CompileView("<p><!--greeting--> <!--name--></p><!-- comment --><!--name--><!--now:2006-->")
+
+	variables := view.Variables()
+	if len(variables) != 3 || variables[0] != "greeting" || variables[1] != "name" || variables[2] != " comment " {
+		t.Errorf("unexpected variables: %v", variables)
+		return
+	}
+
+	html := view.Render(map[string]string{"greeting": "hello", "name": "world"}, nil, false)
+	expected := fmt.Sprintf("<p>hello world</p><!-- comment -->world%d", time.Now().UTC().Year())
+	if html != expected {
+		t.Errorf("unexpected view: %s", html)
+	}
+}
+
+func getBenchmarkViewHtml() string {
+	form := strings.Builder{}
+	for i := 0; i < 50; i++ {
+		form.WriteString(fmt.Sprintf("<label class=\"glabel\"><!--var%d--></label><br/><br/>", i%5))
+	}
+	form.WriteString("<!--now:02 Jan 06 15:04 MST-->")
+	return strings.ReplaceAll(resources.FormTemplate, "<!--form-->", form.String())
+}
+
+func getBenchmarkViewVariables() map[string]string {
+	variables := map[string]string{"server_socket": socket}
+	for i := 0; i < 5; i++ {
+		variables[fmt.Sprintf("var%d", i)] = fmt.Sprintf("value%d", i)
+	}
+	return variables
+}
+
+func BenchmarkGenerateView(b *testing.B) {
+	html := getBenchmarkViewHtml()
+	variables := getBenchmarkViewVariables()
+	handledEvents := []string{"*#gbutton0!click", "*#gbutton1!click"}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ui.GenerateView(html, variables, handledEvents, false)
+	}
+}
+
+func BenchmarkCompiledView(b *testing.B) {
+	view := ui.CompileView(getBenchmarkViewHtml())
+	variables := getBenchmarkViewVariables()
+	handledEvents := []string{"*#gbutton0!click", "*#gbutton1!click"}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		view.Render(variables, handledEvents, false)
+	}
+}
+
+func getNewServer(t *testing.T) *ui.Server {
+	server, err := ui.NewServer(socket)
+	if err != nil {
+		t.Error(err)
+		return nil
+	}
+	return server
+}
+
+func newTestCertificate(t *testing.T, template *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, []byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template.SerialNumber = big.NewInt(rand.Int63())
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(crand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, _ := x509.ParseCertificate(der)
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	return cert, key, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+}
+
+func handleErrorChannel(t *testing.T, errorChan chan error) {
+	go func() {
+		for {
+			err := <-errorChan
 			if err != nil && !errors.Is(err, http.ErrServerClosed) && !websocket.IsCloseError(err, websocket.CloseGoingAway) {
 				t.Error(err)
 				return
@@ -1155,6 +4194,36 @@ func handleErrorChannel(t *testing.T, errorChan chan error) {
 	}()
 }
 
+// getCsrfQuery returns the query that passes a CSRF token to the WebSockets
+// channel, for clients that don't load a view first.
+func getCsrfQuery(server *ui.Server) string {
+	return "?csrf_token=" + url.QueryEscape(server.GenerateCsrfToken(&http.Request{}))
+}
+
+// getPageCsrfQuery returns the query that passes the CSRF token embedded in the
+// page to the WebSockets channel.
+func getPageCsrfQuery(t *testing.T, uri string, header http.Header) string {
+	req, _ := http.NewRequest(http.MethodGet, uri, nil)
+	for key, values := range header {
+		req.Header[key] = values
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Error(err)
+		return ""
+	}
+	body, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+
+	match := regexp.MustCompile(`"csrf_token":"([^"]+)"`).FindSubmatch(body)
+	if match == nil {
+		t.Errorf("page does not contain a CSRF token: %s", body)
+		return ""
+	}
+	return "?csrf_token=" + url.QueryEscape(string(match[1]))
+}
+
 func getResponse(url string) (string, error) {
 	resp, err := http.Get(url)
 	if err != nil {
@@ -1,6 +1,6 @@
 module tonysoft.com/gasp
 
-go 1.17
+go 1.21
 
 require github.com/gorilla/websocket v1.5.1
 
@@ -3,9 +3,10 @@ package console
 import (
 	"errors"
 	"flag"
+	"fmt"
 	"os"
-	"regexp"
 	"strings"
+	ui "tonysoft.com/gasp"
 )
 
 var (
@@ -13,7 +14,7 @@ var (
 )
 
 var (
-	socket  = flag.String("s", "localhost:8800", "socket (<address>:<port>) used for comm")
+	socket  = flag.String("s", "localhost:8800", "socket (<address>:<port>, [<ipv6_address>]:<port>, :<port> or unix:<path>) used for comm")
 	rootDir = flag.String("r", ".", "root directory of the project, if not the current directory")
 )
 
@@ -51,10 +52,9 @@ func validate() error {
 }
 
 func validateSocket(socket string) error {
-	socket = strings.Replace(Args.Socket, "localhost", "127.0.0.1", 1)
-	socketMatch, _ := regexp.MatchString("^(?:[0-9]{1,3}\\.){3}[0-9]{1,3}:[0-9]{1,5}$", socket)
-	if !socketMatch {
-		return errors.New("invalid socket value passed to GoWatch (expected <address>:<port>)")
+	err := ui.ValidateSocket(socket)
+	if err != nil {
+		return fmt.Errorf("invalid socket value passed to GoWatch: %v", err)
 	}
 	return nil
 }
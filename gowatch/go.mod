@@ -1,6 +1,6 @@
 module tonysoft.com/gasp/gowatch
 
-go 1.17
+go 1.21
 
 replace tonysoft.com/gasp => ../
 
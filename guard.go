@@ -0,0 +1,161 @@
+package gasp
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+const (
+	maxRewrites = 10
+)
+
+type guardAction int
+
+const (
+	guardAllow guardAction = iota
+	guardRedirect
+	guardDeny
+	guardRewrite
+)
+
+type Guard func(req *http.Request) GuardDecision
+
+// GuardDecision is what a guard returns to allow a request, redirect the client,
+// deny it with a status and body, or rewrite it to another path on the server.
+type GuardDecision struct {
+	action guardAction
+	status int
+	path   string
+	body   string
+}
+
+type routeGuard struct {
+	pattern *routePattern
+	guard   Guard
+}
+
+func AllowRequest() GuardDecision {
+	return GuardDecision{action: guardAllow}
+}
+
+// RedirectRequest redirects to the path (302 Found unless another 3xx status is
+// given).  Paths are relative to the host the client requested, so the scheme and
+// host are preserved, unless they're absolute ("https://host/path") or
+// scheme-relative ("//host/path") URLs.
+func RedirectRequest(path string, status ...int) GuardDecision {
+	decision := GuardDecision{action: guardRedirect, status: http.StatusFound, path: path}
+	if len(status) > 0 && status[0] >= 300 && status[0] < 400 {
+		decision.status = status[0]
+	}
+	return decision
+}
+
+// DenyRequest responds with the status (403 Forbidden if it isn't an error status)
+// and body, which defaults to the status text.
+func DenyRequest(status int, body ...string) GuardDecision {
+	decision := GuardDecision{action: guardDeny, status: status}
+	if status < 400 || status > 599 {
+		decision.status = http.StatusForbidden
+	}
+	if len(body) > 0 {
+		decision.body = body[0]
+	} else {
+		decision.body = http.StatusText(decision.status)
+	}
+	return decision
+}
+
+// RewriteRequest serves the request as if the path had been requested, without
+// the client being redirected.  The guards for the new path are applied as well.
+func RewriteRequest(path string) GuardDecision {
+	return GuardDecision{action: guardRewrite, path: path}
+}
+
+func (server *Server) AddGuard(path string, guard Guard) error {
+	if guard == nil {
+		return fmt.Errorf("guard for path '%s' cannot be nil", path)
+	}
+
+	pattern, err := parseRoutePattern(path)
+	if err != nil {
+		return err
+	}
+
+	// The WebSockets channel is never guarded, so a guard for it would silently
+	// have no effect.
+	if len(pattern.segments) > 0 && "/"+pattern.segments[0].literal == websocketsPath {
+		return errors.New("path cannot be '/gaspws', which is reserved for the WebSockets channel")
+	}
+
+	for _, g := range server.guards {
+		if g.pattern.text == pattern.text {
+			return fmt.Errorf("path '%s' already guarded", pattern.text)
+		}
+	}
+
+	server.guards = append(server.guards, &routeGuard{pattern: pattern, guard: guard})
+	sort.SliceStable(server.guards, func(i, j int) bool {
+		return server.guards[j].pattern.moreSpecific(server.guards[i].pattern)
+	})
+	return nil
+}
+
+// AddRouteGuard adds a guard that redirects the request to the path it returns,
+// or allows it if the path is nil.
+func (server *Server) AddRouteGuard(path string, guardFunc func(req *http.Request) (newPath *string)) error {
+	if guardFunc == nil {
+		return fmt.Errorf("guard for path '%s' cannot be nil", path)
+	}
+
+	return server.AddGuard(path, func(req *http.Request) GuardDecision {
+		newPath := guardFunc(req)
+		if newPath == nil {
+			return AllowRequest()
+		}
+		return RedirectRequest(*newPath)
+	})
+}
+
+// applyGuards applies the guards whose patterns match the request, starting with
+// the least specific so that guards for a subtree run before those for the paths
+// within it.  It returns the decision of the first guard that doesn't allow the
+// request.
+func (server *Server) applyGuards(req *http.Request) GuardDecision {
+	for _, g := range server.guards {
+		if !g.pattern.allowsMethod(req.Method) {
+			continue
+		}
+
+		params, ok := g.pattern.match(req.URL.Path)
+		if !ok {
+			continue
+		}
+
+		guardReq := req
+		if params != nil {
+			guardReq = withRouteParams(req, params)
+		}
+
+		decision := g.guard(guardReq)
+		if decision.action != guardAllow {
+			return decision
+		}
+	}
+	return AllowRequest()
+}
+
+func (decision GuardDecision) apply(rw http.ResponseWriter, req *http.Request) {
+	switch decision.action {
+	case guardRedirect:
+		location := decision.path
+		if !strings.HasPrefix(location, "/") && !strings.Contains(location, "://") {
+			location = "/" + location
+		}
+		http.Redirect(rw, req, location, decision.status)
+	case guardDeny:
+		http.Error(rw, decision.body, decision.status)
+	}
+}
@@ -0,0 +1,151 @@
+package gasp
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	blockStartPrefix = "<!--block:"
+	blockEnd         = "<!--/block-->"
+	maxLayoutDepth   = 16
+)
+
+var (
+	layoutRegex     = regexp.MustCompile(`<!--layout:([\w\-]+)-->`)
+	layoutNameRegex = regexp.MustCompile(`^[\w\-]+$`)
+)
+
+type block struct {
+	name    string
+	start   int
+	end     int
+	content string
+}
+
+// AddLayout registers a layout that views (and other layouts) can extend by
+// starting with <!--layout:name-->.  Layouts define named blocks, which may hold
+// default content, as <!--block:name-->...<!--/block--> and views replace them by
+// defining blocks with the same names.  Layouts must be added before the views
+// that use them.
+func (server *Server) AddLayout(name string, html string) error {
+	if !layoutNameRegex.MatchString(name) {
+		return fmt.Errorf("invalid layout name '%s'", name)
+	}
+
+	if _, ok := server.layouts[name]; ok {
+		return fmt.Errorf("layout '%s' already added", name)
+	}
+
+	_, err := parseBlocks(html)
+	if err != nil {
+		return fmt.Errorf("invalid layout '%s': %v", name, err)
+	}
+
+	server.layouts[name] = html
+	return nil
+}
+
+// applyLayouts replaces a view with the layout it extends, recursively, filling
+// each block with the content from the most derived definition.
+func (server *Server) applyLayouts(html string) (string, error) {
+	definitions := make(map[string]string)
+
+	for depth := 0; ; depth++ {
+		blocks, err := parseBlocks(html)
+		if err != nil {
+			return "", err
+		}
+
+		for _, b := range blocks {
+			if _, ok := definitions[b.name]; !ok {
+				definitions[b.name] = b.content
+			}
+		}
+
+		match := layoutRegex.FindStringSubmatch(html)
+		if match == nil {
+			break
+		}
+
+		if depth == maxLayoutDepth {
+			return "", errors.New("too many nested layouts, check for a layout that extends itself")
+		}
+
+		layout, ok := server.layouts[match[1]]
+		if !ok {
+			return "", fmt.Errorf("layout '%s' not found", match[1])
+		}
+		html = layout
+	}
+
+	return replaceBlocks(html, func(b block) string {
+		return definitions[b.name]
+	})
+}
+
+func replaceBlocks(html string, replace func(b block) string) (string, error) {
+	blocks, err := parseBlocks(html)
+	if err != nil {
+		return "", err
+	}
+
+	builder := strings.Builder{}
+	last := 0
+	for _, b := range blocks {
+		builder.WriteString(html[last:b.start])
+		builder.WriteString(replace(b))
+		last = b.end
+	}
+	builder.WriteString(html[last:])
+
+	return builder.String(), nil
+}
+
+func parseBlocks(html string) ([]block, error) {
+	blocks := make([]block, 0)
+
+	offset := 0
+	for {
+		start := strings.Index(html[offset:], blockStartPrefix)
+		if start < 0 {
+			break
+		}
+		start += offset
+
+		nameEnd := strings.Index(html[start:], "-->")
+		if nameEnd < 0 {
+			return nil, errors.New("unterminated block comment")
+		}
+		nameEnd += start
+
+		name := html[start+len(blockStartPrefix) : nameEnd]
+		if !layoutNameRegex.MatchString(name) {
+			return nil, fmt.Errorf("invalid block name '%s'", name)
+		}
+
+		contentStart := nameEnd + 3
+		contentEnd := strings.Index(html[contentStart:], blockEnd)
+		if contentEnd < 0 {
+			return nil, fmt.Errorf("block '%s' is missing its closing <!--/block-->", name)
+		}
+		contentEnd += contentStart
+
+		content := html[contentStart:contentEnd]
+		if strings.Contains(content, blockStartPrefix) {
+			return nil, fmt.Errorf("block '%s' cannot contain other blocks", name)
+		}
+
+		blocks = append(blocks, block{
+			name:    name,
+			start:   start,
+			end:     contentEnd + len(blockEnd),
+			content: content,
+		})
+		offset = contentEnd + len(blockEnd)
+	}
+
+	return blocks, nil
+}
@@ -0,0 +1,184 @@
+package gasp
+
+import (
+	"errors"
+	"github.com/gorilla/websocket"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultMaxMessageSize = 1 << 20
+	pingWriteTimeout      = 10 * time.Second
+)
+
+// RateLimit allows Rate events per second on average, with bursts of up to Burst
+// events (at least 1).  A zero Rate means no limit.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+type ThrottleStats struct {
+	Throttled       uint64
+	ThrottledByType map[string]uint64
+	Oversized       uint64
+	TimedOut        uint64
+}
+
+type throttleCounters struct {
+	throttled   atomic.Uint64
+	oversized   atomic.Uint64
+	timedOut    atomic.Uint64
+	byTypeMutex sync.Mutex
+	byType      map[string]uint64
+}
+
+type rateLimiter struct {
+	limit  RateLimit
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(limit RateLimit) *rateLimiter {
+	if limit.Rate <= 0 {
+		return nil
+	}
+	if limit.Burst < 1 {
+		limit.Burst = 1
+	}
+	return &rateLimiter{limit: limit, tokens: float64(limit.Burst), last: time.Now()}
+}
+
+func (limiter *rateLimiter) allow(now time.Time) bool {
+	if limiter == nil {
+		return true
+	}
+
+	limiter.tokens += now.Sub(limiter.last).Seconds() * limiter.limit.Rate
+	if limiter.tokens > float64(limiter.limit.Burst) {
+		limiter.tokens = float64(limiter.limit.Burst)
+	}
+	limiter.last = now
+
+	if limiter.tokens < 1 {
+		return false
+	}
+	limiter.tokens--
+	return true
+}
+
+func (server *Server) ThrottleStats() ThrottleStats {
+	counters := &server.throttleCounters
+	stats := ThrottleStats{
+		Throttled:       counters.throttled.Load(),
+		ThrottledByType: make(map[string]uint64),
+		Oversized:       counters.oversized.Load(),
+		TimedOut:        counters.timedOut.Load(),
+	}
+
+	counters.byTypeMutex.Lock()
+	defer counters.byTypeMutex.Unlock()
+	for eventType, count := range counters.byType {
+		stats.ThrottledByType[eventType] = count
+	}
+	return stats
+}
+
+// allowEvent applies the client's rate limit and then the limit for the event's
+// type, counting the events that are dropped.
+func (server *Server) allowEvent(c *client, event *ClientEvent) bool {
+	now := time.Now()
+
+	if !c.limiter.allow(now) {
+		server.throttleCounters.throttled.Add(1)
+		return false
+	}
+
+	// Only the configured types get a limiter, as the client chooses the event types
+	// and could otherwise grow the map without bound.
+	limit, ok := server.options.EventRateLimits[event.Type]
+	if !ok {
+		return true
+	}
+
+	limiter, ok := c.typeLimiters[event.Type]
+	if !ok {
+		limiter = newRateLimiter(limit)
+		c.typeLimiters[event.Type] = limiter
+	}
+
+	if !limiter.allow(now) {
+		counters := &server.throttleCounters
+		counters.throttled.Add(1)
+		counters.byTypeMutex.Lock()
+		if counters.byType == nil {
+			counters.byType = make(map[string]uint64)
+		}
+		counters.byType[event.Type]++
+		counters.byTypeMutex.Unlock()
+		return false
+	}
+
+	return true
+}
+
+// configureConnection limits the size of incoming messages and, if an idle timeout
+// is set, closes connections that don't send anything (including a pong) in time.
+func (server *Server) configureConnection(ws *websocket.Conn) {
+	maxMessageSize := server.options.MaxMessageSize
+	if maxMessageSize == 0 {
+		maxMessageSize = defaultMaxMessageSize
+	}
+	if maxMessageSize > 0 {
+		ws.SetReadLimit(maxMessageSize)
+	}
+
+	server.extendReadDeadline(ws)
+	ws.SetPongHandler(func(string) error {
+		server.extendReadDeadline(ws)
+		return nil
+	})
+}
+
+func (server *Server) extendReadDeadline(ws *websocket.Conn) {
+	if server.options.IdleTimeout > 0 {
+		_ = ws.SetReadDeadline(time.Now().Add(server.options.IdleTimeout))
+	}
+}
+
+// keepAlive pings the client every PingInterval until done is closed.
+func (server *Server) keepAlive(c *client, done chan struct{}) {
+	if server.options.PingInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(server.options.PingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			err := c.ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(pingWriteTimeout))
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+// countReadError counts reads that failed because a message was too large or the
+// client was idle for too long.
+func (server *Server) countReadError(err error) {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, websocket.ErrReadLimit):
+		server.throttleCounters.oversized.Add(1)
+	case errors.As(err, &netErr) && netErr.Timeout():
+		server.throttleCounters.timedOut.Add(1)
+	}
+}
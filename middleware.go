@@ -0,0 +1,252 @@
+package gasp
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	requestIdHeader = "X-Request-ID"
+)
+
+type Middleware func(next http.Handler) http.Handler
+
+type requestIdKey struct{}
+
+type CorsOptions struct {
+	AllowedOrigins   []string
+	AllowedMethods   []string
+	AllowedHeaders   []string
+	ExposedHeaders   []string
+	AllowCredentials bool
+	MaxAge           time.Duration
+}
+
+// responseRecorder captures the status of a response while still allowing the
+// connection to be hijacked, which the WebSockets upgrade requires.
+type responseRecorder struct {
+	http.ResponseWriter
+	status  int
+	written bool
+}
+
+func (recorder *responseRecorder) WriteHeader(status int) {
+	if !recorder.written {
+		recorder.status = status
+		recorder.written = true
+	}
+	recorder.ResponseWriter.WriteHeader(status)
+}
+
+func (recorder *responseRecorder) Write(b []byte) (int, error) {
+	if !recorder.written {
+		recorder.status = http.StatusOK
+		recorder.written = true
+	}
+	return recorder.ResponseWriter.Write(b)
+}
+
+func (recorder *responseRecorder) Flush() {
+	if flusher, ok := recorder.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (recorder *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := recorder.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("the response writer does not support hijacking")
+	}
+
+	conn, rw, err := hijacker.Hijack()
+	if err == nil && !recorder.written {
+		recorder.status = http.StatusSwitchingProtocols
+		recorder.written = true
+	}
+	return conn, rw, err
+}
+
+func (recorder *responseRecorder) Unwrap() http.ResponseWriter {
+	return recorder.ResponseWriter
+}
+
+func newResponseRecorder(rw http.ResponseWriter) *responseRecorder {
+	if recorder, ok := rw.(*responseRecorder); ok {
+		return recorder
+	}
+	return &responseRecorder{ResponseWriter: rw}
+}
+
+// Use adds middleware that wraps every route, including resources and the
+// WebSockets channel.  The first middleware added is the outermost.
+func (server *Server) Use(middleware ...Middleware) {
+	server.middlewareMutex.Lock()
+	defer server.middlewareMutex.Unlock()
+
+	for _, m := range middleware {
+		if m != nil {
+			server.middleware = append(server.middleware, m)
+		}
+	}
+	server.handler = nil
+}
+
+func (server *Server) getHandler() http.Handler {
+	server.middlewareMutex.Lock()
+	defer server.middlewareMutex.Unlock()
+
+	if server.handler == nil {
+		var handler http.Handler = http.HandlerFunc(server.route)
+		for i := len(server.middleware) - 1; i >= 0; i-- {
+			handler = server.middleware[i](handler)
+		}
+		if server.options.Sessions.Store != nil {
+			handler = server.handleSessions(handler)
+		}
+		server.handler = handler
+	}
+	return server.handler
+}
+
+// LogRequests logs each request once it's been handled.  The WebSockets upgrade
+// is logged when the connection ends, with a 101 status and the lifetime of the
+// connection as its duration.
+func LogRequests(logger *slog.Logger) Middleware {
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			start := time.Now()
+			recorder := newResponseRecorder(rw)
+			next.ServeHTTP(recorder, req)
+
+			attributes := []any{
+				"method", req.Method,
+				"path", req.URL.Path,
+				"status", recorder.status,
+				"duration", time.Since(start),
+				"remote_addr", req.RemoteAddr,
+			}
+			if requestId := GetRequestId(req); requestId != "" {
+				attributes = append(attributes, "request_id", requestId)
+			}
+			logger.Info("gasp: request handled", attributes...)
+		})
+	}
+}
+
+func RecoverRequests(onPanic func(req *http.Request, recovered interface{}, stack []byte)) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			recorder := newResponseRecorder(rw)
+			defer func() {
+				r := recover()
+				if r == nil {
+					return
+				}
+				if r == http.ErrAbortHandler {
+					panic(r)
+				}
+				if onPanic != nil {
+					onPanic(req, r, debug.Stack())
+				}
+				if !recorder.written {
+					http.Error(recorder, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				}
+			}()
+			next.ServeHTTP(recorder, req)
+		})
+	}
+}
+
+// AddRequestIds assigns each request an ID, keeping one provided by the client
+// in the X-Request-ID header, and returns it in the same header of the response.
+func AddRequestIds() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			requestId := req.Header.Get(requestIdHeader)
+			if requestId == "" || len(requestId) > 128 {
+				idBytes := make([]byte, 16)
+				_, _ = rand.Read(idBytes)
+				requestId = hex.EncodeToString(idBytes)
+			}
+
+			rw.Header().Set(requestIdHeader, requestId)
+			next.ServeHTTP(rw, req.WithContext(context.WithValue(req.Context(), requestIdKey{}, requestId)))
+		})
+	}
+}
+
+func GetRequestId(req *http.Request) string {
+	requestId, _ := req.Context().Value(requestIdKey{}).(string)
+	return requestId
+}
+
+// Cors adds the CORS headers for the allowed origins ("*" allows any origin) and
+// answers preflight requests.
+func Cors(options CorsOptions) Middleware {
+	if len(options.AllowedMethods) == 0 {
+		options.AllowedMethods = []string{http.MethodGet, http.MethodHead, http.MethodPost}
+	}
+
+	allowsOrigin := func(origin string) bool {
+		for _, allowed := range options.AllowedOrigins {
+			if allowed == "*" || strings.EqualFold(allowed, origin) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			origin := req.Header.Get("Origin")
+			if origin == "" {
+				next.ServeHTTP(rw, req)
+				return
+			}
+
+			rw.Header().Add("Vary", "Origin")
+			if !allowsOrigin(origin) {
+				next.ServeHTTP(rw, req)
+				return
+			}
+
+			rw.Header().Set("Access-Control-Allow-Origin", origin)
+			if options.AllowCredentials {
+				rw.Header().Set("Access-Control-Allow-Credentials", "true")
+			}
+
+			if req.Method != http.MethodOptions || req.Header.Get("Access-Control-Request-Method") == "" {
+				if len(options.ExposedHeaders) > 0 {
+					rw.Header().Set("Access-Control-Expose-Headers", strings.Join(options.ExposedHeaders, ", "))
+				}
+				next.ServeHTTP(rw, req)
+				return
+			}
+
+			rw.Header().Set("Access-Control-Allow-Methods", strings.Join(options.AllowedMethods, ", "))
+			if len(options.AllowedHeaders) > 0 {
+				rw.Header().Set("Access-Control-Allow-Headers", strings.Join(options.AllowedHeaders, ", "))
+			} else if requested := req.Header.Get("Access-Control-Request-Headers"); requested != "" {
+				rw.Header().Set("Access-Control-Allow-Headers", requested)
+			}
+			if options.MaxAge > 0 {
+				rw.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(options.MaxAge.Seconds())))
+			}
+			rw.WriteHeader(http.StatusNoContent)
+		})
+	}
+}
@@ -0,0 +1,230 @@
+package gasp
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	defaultQueueSize    = 10000
+	defaultMaxBatchSize = 100
+)
+
+type QueuePolicy int
+
+const (
+	QueueDropNewest QueuePolicy = iota
+	QueueDropOldest
+	QueueBlock
+	QueueDisconnect
+)
+
+type QueueStats struct {
+	Dropped      uint64
+	Coalesced    uint64
+	Disconnected uint64
+	Batches      uint64
+}
+
+type queueCounters struct {
+	dropped      atomic.Uint64
+	coalesced    atomic.Uint64
+	disconnected atomic.Uint64
+	batches      atomic.Uint64
+}
+
+type queuedEvent struct {
+	event   *ServerEvent
+	key     string
+	control string
+}
+
+type eventQueue struct {
+	mutex      sync.Mutex
+	cond       *sync.Cond
+	items      []*queuedEvent
+	size       int
+	policy     QueuePolicy
+	coalescing bool
+	closed     bool
+	counters   *queueCounters
+}
+
+func newEventQueue(size int, policy QueuePolicy, coalescing bool, counters *queueCounters) *eventQueue {
+	if size < 1 {
+		size = defaultQueueSize
+	}
+
+	queue := eventQueue{
+		size:       size,
+		policy:     policy,
+		coalescing: coalescing,
+		counters:   counters,
+	}
+	queue.cond = sync.NewCond(&queue.mutex)
+	return &queue
+}
+
+// push returns false if the event could not be queued and the client should be
+// disconnected, as per the QueueDisconnect policy.
+func (queue *eventQueue) push(event *ServerEvent) bool {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	if queue.closed {
+		return true
+	}
+
+	key, control := "", ""
+	if queue.coalescing {
+		key, control = coalesceKey(event)
+		if key != "" && queue.coalesce(event, key, control) {
+			queue.counters.coalesced.Add(1)
+			return true
+		}
+	}
+
+	for len(queue.items) >= queue.size {
+		switch queue.policy {
+		case QueueDropOldest:
+			queue.items = queue.items[1:]
+			queue.counters.dropped.Add(1)
+		case QueueBlock:
+			queue.cond.Wait()
+			if queue.closed {
+				return true
+			}
+		case QueueDisconnect:
+			queue.counters.disconnected.Add(1)
+			return false
+		default:
+			queue.counters.dropped.Add(1)
+			return true
+		}
+	}
+
+	queue.items = append(queue.items, &queuedEvent{event: event, key: key, control: control})
+	queue.cond.Broadcast()
+	return true
+}
+
+// coalesce merges the event into a pending one for the same control property,
+// unless an event that must keep its relative order (such as a form update, a
+// custom event or another update of the same control) was queued after it.  Form
+// updates are only merged into the last pending event.
+func (queue *eventQueue) coalesce(event *ServerEvent, key string, control string) bool {
+	for i := len(queue.items) - 1; i >= 0; i-- {
+		pending := queue.items[i]
+		if pending.key == key {
+			pending.event = mergeEvents(pending.event, event)
+			return true
+		}
+		if control == "" || pending.key == "" || pending.control == control || pending.event.Type == "form_update" {
+			return false
+		}
+	}
+	return false
+}
+
+// pop blocks until at least one event is queued, returning up to max events, or
+// false once the queue has been closed.
+func (queue *eventQueue) pop(max int) ([]*ServerEvent, bool) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	for len(queue.items) == 0 && !queue.closed {
+		queue.cond.Wait()
+	}
+
+	if queue.closed {
+		return nil, false
+	}
+
+	count := len(queue.items)
+	if max > 0 && count > max {
+		count = max
+	}
+
+	events := make([]*ServerEvent, count)
+	for i := 0; i < count; i++ {
+		events[i] = queue.items[i].event
+	}
+	queue.items = queue.items[count:]
+
+	queue.cond.Broadcast()
+	return events, true
+}
+
+func (queue *eventQueue) close() {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	queue.closed = true
+	queue.items = nil
+	queue.cond.Broadcast()
+}
+
+// coalesceKey returns the key of the events that can be merged with the event, and
+// the ID of the control it updates (empty for form updates).
+func coalesceKey(event *ServerEvent) (string, string) {
+	if event.Type == "form_update" {
+		return event.Type, ""
+	}
+
+	if !strings.HasSuffix(event.Type, "_update") || event.Data == nil {
+		return "", ""
+	}
+
+	properties, ok := event.Data["properties"].([]string)
+	if !ok || len(properties) == 0 {
+		return "", ""
+	}
+
+	state, ok := event.Data["state"].(interface{ controlId() string })
+	if !ok {
+		return "", ""
+	}
+
+	key := event.Type + "#" + state.controlId() + "!" + strings.Join(properties, ",")
+
+	if lineChartState, ok := event.Data["state"].(*LineChartState); ok && key == event.Type+"#"+lineChartState.Id+"!values" {
+		for _, line := range lineChartState.Lines {
+			key += "," + line.Name
+		}
+	}
+
+	return key, state.controlId()
+}
+
+// mergeEvents returns the event that replaces the pending one.  Line chart values
+// are appended to those still pending, whereas every other update supersedes it.
+func mergeEvents(pending *ServerEvent, event *ServerEvent) *ServerEvent {
+	pendingState, ok := pending.Data["state"].(*LineChartState)
+	if !ok {
+		return event
+	}
+
+	state, ok := event.Data["state"].(*LineChartState)
+	if !ok || len(state.Lines) != len(pendingState.Lines) {
+		return event
+	}
+
+	mergedState := *state
+	mergedState.Lines = make([]*LineState, len(state.Lines))
+	for i, line := range state.Lines {
+		mergedLine := *line
+		mergedLine.NewValues = make([]float64, 0, len(pendingState.Lines[i].NewValues)+len(line.NewValues))
+		mergedLine.NewValues = append(mergedLine.NewValues, pendingState.Lines[i].NewValues...)
+		mergedLine.NewValues = append(mergedLine.NewValues, line.NewValues...)
+		mergedState.Lines[i] = &mergedLine
+	}
+
+	merged := *event
+	merged.Data = make(map[string]interface{}, len(event.Data))
+	for k, v := range event.Data {
+		merged.Data[k] = v
+	}
+	merged.Data["state"] = &mergedState
+	return &merged
+}
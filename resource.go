@@ -0,0 +1,335 @@
+package gasp
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultStreamThreshold = 1 << 20
+)
+
+var (
+	precompressedEncodings = []struct {
+		encoding  string
+		extension string
+	}{
+		{encoding: "br", extension: ".br"},
+		{encoding: "gzip", extension: ".gz"},
+	}
+)
+
+// ResourceOptions configures how resources are served.  Files no larger than the
+// StreamThreshold (1 MiB by default, or every file if it's negative) are loaded
+// into memory when they're added, whereas larger files are read from the file
+// system for each request.  A file's .br and .gz variants are served in its place
+// to clients that accept the encoding.
+type ResourceOptions struct {
+	ExcludedFileExtensions []string
+	IndexFiles             []string
+	NotFoundHandler        http.HandlerFunc
+	CacheControl           string
+	StreamThreshold        int64
+}
+
+type resourceFile struct {
+	name     string
+	modTime  time.Time
+	content  []byte
+	etag     string
+	variants map[string]*resourceFile
+}
+
+type resourceHandler struct {
+	server  *Server
+	fsys    fs.FS
+	options ResourceOptions
+}
+
+func (server *Server) AddResourcesWithOptions(directory string, options ResourceOptions) error {
+	if strings.TrimSpace(directory) == "" {
+		return errors.New("parameter 'directory' cannot be empty/whitespace")
+	}
+
+	dirInfo, err := os.Stat(directory)
+	if err != nil && errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("resources directory '%s' does not exist", directory)
+	}
+
+	if !dirInfo.IsDir() {
+		return fmt.Errorf("'%s' is not a directory", directory)
+	}
+
+	return server.AddResourcesFSWithOptions("", os.DirFS(directory), options)
+}
+
+func (server *Server) AddResourcesFSWithOptions(prefix string, fsys fs.FS, options ResourceOptions) error {
+	if fsys == nil {
+		return errors.New("parameter 'fsys' cannot be nil")
+	}
+
+	if options.StreamThreshold == 0 {
+		options.StreamThreshold = defaultStreamThreshold
+	}
+
+	handler := resourceHandler{
+		server:  server,
+		fsys:    fsys,
+		options: options,
+	}
+
+	names := make(map[string]bool)
+	directories := make([]string, 0)
+	err := fs.WalkDir(fsys, ".", func(name string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			directories = append(directories, name)
+			return nil
+		}
+		for _, ext := range options.ExcludedFileExtensions {
+			if strings.HasSuffix(entry.Name(), ext) {
+				return nil
+			}
+		}
+		names[name] = true
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to add resources directory: %v", err)
+	}
+
+	files := make(map[string]*resourceFile)
+	for name := range names {
+		if isPrecompressedVariant(name, names) {
+			continue
+		}
+
+		file, err := handler.loadFile(name)
+		if err != nil {
+			return fmt.Errorf("failed to add resources directory: %v", err)
+		}
+
+		for _, p := range precompressedEncodings {
+			if names[name+p.extension] {
+				variant, err := handler.loadFile(name + p.extension)
+				if err != nil {
+					return fmt.Errorf("failed to add resources directory: %v", err)
+				}
+				file.variants[p.encoding] = variant
+			}
+		}
+
+		files[name] = file
+	}
+
+	for name, file := range files {
+		file := file
+		urlPath := path.Join("/", prefix, name)
+		err = server.AddRouteHandler(urlPath, func(rw http.ResponseWriter, req *http.Request) {
+			handler.serveFile(rw, req, file)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to add resources directory: %v", err)
+		}
+
+		if server.options.DevMode && !file.modTime.IsZero() {
+			server.watcher.watch(fsys, name, func() {
+				if path.Ext(name) == ".css" {
+					server.sendReloadEvent("css", urlPath)
+				} else {
+					server.sendReloadEvent("page", "")
+				}
+			})
+		}
+	}
+
+	for _, dir := range directories {
+		var index *resourceFile
+		for _, indexFile := range options.IndexFiles {
+			if file, ok := files[path.Join(dir, indexFile)]; ok {
+				index = file
+				break
+			}
+		}
+
+		isRoot := dir == "."
+		if index == nil && (!isRoot || strings.Trim(prefix, "/") == "") {
+			continue
+		}
+
+		dirPath := path.Join("/", prefix, dir)
+		if dirPath != "/" {
+			dirPath += "/"
+		}
+
+		err = server.AddRouteHandler(dirPath, func(rw http.ResponseWriter, req *http.Request) {
+			if index == nil || req.URL.Path != dirPath {
+				handler.notFound(rw, req)
+				return
+			}
+			handler.serveFile(rw, req, index)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to add resources directory: %v", err)
+		}
+	}
+
+	return nil
+}
+
+func isPrecompressedVariant(name string, names map[string]bool) bool {
+	for _, p := range precompressedEncodings {
+		if strings.HasSuffix(name, p.extension) && names[strings.TrimSuffix(name, p.extension)] {
+			return true
+		}
+	}
+	return false
+}
+
+func (handler *resourceHandler) loadFile(name string) (*resourceFile, error) {
+	info, err := fs.Stat(handler.fsys, name)
+	if err != nil {
+		return nil, err
+	}
+
+	file := resourceFile{
+		name:     name,
+		modTime:  info.ModTime(),
+		variants: make(map[string]*resourceFile),
+	}
+
+	// in development mode files are always read from the file system so changes are
+	// served, whereas files without a modification time (such as those in an embed.FS)
+	// can't be validated by it, so they're always hashed
+	if handler.server.options.DevMode && !file.modTime.IsZero() {
+		return &file, nil
+	}
+
+	if handler.options.StreamThreshold < 0 || info.Size() <= handler.options.StreamThreshold || file.modTime.IsZero() {
+		content, err := fs.ReadFile(handler.fsys, name)
+		if err != nil {
+			return nil, err
+		}
+
+		hash := sha256.Sum256(content)
+		file.etag = "\"" + hex.EncodeToString(hash[:16]) + "\""
+
+		if handler.options.StreamThreshold < 0 || int64(len(content)) <= handler.options.StreamThreshold {
+			file.content = content
+		}
+	}
+
+	return &file, nil
+}
+
+func (handler *resourceHandler) serveFile(rw http.ResponseWriter, req *http.Request, file *resourceFile) {
+	contentType := mime.TypeByExtension(path.Ext(file.name))
+
+	if len(file.variants) > 0 {
+		rw.Header().Add("Vary", "Accept-Encoding")
+		for _, p := range precompressedEncodings {
+			if variant, ok := file.variants[p.encoding]; ok && acceptsEncoding(req, p.encoding) {
+				rw.Header().Set("Content-Encoding", p.encoding)
+				if contentType == "" {
+					contentType = "application/octet-stream"
+				}
+				file = variant
+				break
+			}
+		}
+	}
+
+	if contentType != "" {
+		rw.Header().Set("Content-Type", contentType)
+	}
+
+	if handler.options.CacheControl != "" {
+		rw.Header().Set("Cache-Control", handler.options.CacheControl)
+	}
+
+	if file.content != nil {
+		rw.Header().Set("ETag", file.etag)
+		http.ServeContent(rw, req, file.name, file.modTime, bytes.NewReader(file.content))
+		return
+	}
+
+	f, err := handler.fsys.Open(file.name)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			handler.notFound(rw, req)
+			return
+		}
+		rw.WriteHeader(http.StatusInternalServerError)
+		handler.server.sendError(ErrorSourceResource, err)
+		return
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	info, err := f.Stat()
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		handler.server.sendError(ErrorSourceResource, err)
+		return
+	}
+
+	etag := file.etag
+	if !info.ModTime().IsZero() {
+		etag = "\"" + strconv.FormatInt(info.ModTime().UnixNano(), 16) + "-" + strconv.FormatInt(info.Size(), 16) + "\""
+	}
+	rw.Header().Set("ETag", etag)
+
+	content, ok := f.(io.ReadSeeker)
+	if !ok {
+		data, err := io.ReadAll(f)
+		if err != nil {
+			rw.WriteHeader(http.StatusInternalServerError)
+			handler.server.sendError(ErrorSourceResource, err)
+			return
+		}
+		content = bytes.NewReader(data)
+	}
+
+	http.ServeContent(rw, req, file.name, info.ModTime(), content)
+}
+
+func (handler *resourceHandler) notFound(rw http.ResponseWriter, req *http.Request) {
+	if handler.options.NotFoundHandler != nil {
+		handler.options.NotFoundHandler(rw, req)
+		return
+	}
+	http.NotFound(rw, req)
+}
+
+func acceptsEncoding(req *http.Request, encoding string) bool {
+	for _, value := range strings.Split(req.Header.Get("Accept-Encoding"), ",") {
+		params := strings.Split(value, ";")
+		if strings.TrimSpace(params[0]) != encoding {
+			continue
+		}
+		for _, param := range params[1:] {
+			q := strings.TrimSpace(param)
+			if strings.HasPrefix(q, "q=") {
+				weight, err := strconv.ParseFloat(strings.TrimPrefix(q, "q="), 64)
+				return err != nil || weight > 0
+			}
+		}
+		return true
+	}
+	return false
+}
@@ -299,6 +299,33 @@ const GASP_proto = {
             }
         }
     },
+    updateFragment(data) {
+        let regions = document.querySelectorAll('[data-gasp-fragment]');
+        for (let i = 0; i < regions.length; i++) {
+            if (regions[i].dataset.gaspFragment === data.name) {
+                regions[i].innerHTML = data.html;
+            }
+        }
+        this.initControls();
+    },
+    reload(data) {
+        if (data && data.kind === 'css') {
+            let links = document.querySelectorAll('link[rel="stylesheet"]');
+            let swapped = false;
+            for (let i = 0; i < links.length; i++) {
+                let url = new URL(links[i].href, window.location.href);
+                if (url.pathname === data.path) {
+                    url.searchParams.set('gasp_reload', Date.now().toString());
+                    links[i].href = url.toString();
+                    swapped = true;
+                }
+            }
+            if (swapped) {
+                return;
+            }
+        }
+        window.location.reload();
+    },
     updatePacketInspector(data) {
         let inspector = null;
         for (let i = 0; i < this.packetinspectors.length; i++) {
@@ -334,17 +361,44 @@ const GASP_proto = {
     sendEvent(evt) {
         this.socket.send(JSON.stringify(evt));
     },
-    addControlEventHandler(id, eventType) {
-        if (id === '*') {
+    addControlEventHandler(id, eventType, pattern) {
+        if (id === '*' || pattern) {
+            let regex = null;
+            if (pattern) {
+                try {
+                    regex = new RegExp(pattern);
+                } catch (e) {
+                    return;
+                }
+            }
+
+            let selector = regex ? '[id]' : '.gbutton, .gtextbox, .glabel, .gdropdown, .gcheckbox, .glinechart, .gpacketinspector';
+            let controls = document.querySelectorAll(selector);
+            for (let i = 0; i < controls.length; i++) {
+                if (!regex || regex.test(controls[i].id)) {
+                    this.addElementEventHandler(controls[i], eventType);
+                }
+            }
             return;
         }
+
         let ctl = document.getElementById(id);
         if (!ctl) {
             return;
         }
+        this.addElementEventHandler(ctl, eventType);
+    },
+    addElementEventHandler(ctl, eventType) {
+        if (!ctl.gaspEventTypes) {
+            ctl.gaspEventTypes = [];
+        }
+        if (ctl.gaspEventTypes.includes(eventType)) {
+            return;
+        }
+        ctl.gaspEventTypes.push(eventType);
 
         ctl.addEventListener(eventType, (evt) => {
-            this.sendEvent(this.newEvent(id, evt.type))
+            this.sendEvent(this.newEvent(ctl.id, evt.type))
         });
     },
     addServerEventHandler(eventType, func) {
@@ -358,6 +412,15 @@ const GASP_proto = {
 
         this.serverEventHandlers[eventType].push(func);
     },
+    invokeServerEventHandlers(evt) {
+        if (this.serverEventHandlers) {
+            if (this.serverEventHandlers[evt.type]) {
+                for (let i = 0; i < this.serverEventHandlers[evt.type].length; i++) {
+                    this.serverEventHandlers[evt.type][i](evt);
+                }
+            }
+        }
+    },
     tick(timestamp) {
         if (this.linecharts) {
             for (let i = 0; i < this.linecharts.length; i++) {
@@ -427,7 +490,9 @@ const GASP_proto = {
                 id = 'glinechart' + i;
                 canvas.id = id;
             }
-            canvas.linechart = this.initLineChart(id);
+            if (!canvas.linechart) {
+                canvas.linechart = this.initLineChart(id);
+            }
             this.linecharts.push(canvas);
             shouldRequestAnimationFrame = true;
         }
@@ -441,14 +506,20 @@ const GASP_proto = {
                 id = 'gpacketinspector' + i;
                 canvas.id = id;
             }
-            canvas.packetinspector = this.initPacketInspector(id);
+            if (!canvas.packetinspector) {
+                canvas.packetinspector = this.initPacketInspector(id);
+            }
             this.packetinspectors.push(canvas);
             shouldRequestAnimationFrame = true;
         }
 
-        /*event_handlers*/
+        let handlers = this.getConfig().handlers ?? [];
+        for (let i = 0; i < handlers.length; i++) {
+            this.addControlEventHandler(handlers[i].id, handlers[i].type, handlers[i].pattern);
+        }
 
-        if (shouldRequestAnimationFrame) {
+        if (shouldRequestAnimationFrame && !this.animating) {
+            this.animating = true;
             window.requestAnimationFrame(this.frameRequestCallback);
         }
     },
@@ -872,8 +943,8 @@ const GASP_proto = {
             return inspector;
         };
 
-        inspector.updateBytes = function (packetBase64) {
-            inspector.bytes = inspector.base64ToArray(packetBase64);
+        inspector.updateBytes = function (packet) {
+            inspector.bytes = (packet instanceof Uint8Array) ? packet : inspector.base64ToArray(packet);
             inspector.isDirty = true;
 
             inspector.updateSelection();
@@ -989,7 +1060,13 @@ const GASP_proto = {
         if (useTls === undefined) {
             useTls = false;
         }
-        /*tls_override*/
+        if (this.getConfig().use_tls !== undefined) {
+            useTls = this.getConfig().use_tls;
+        }
+        if (!serverSocket) {
+            serverSocket = window.location.host;
+            useTls = window.location.protocol === 'https:';
+        }
 
         let wsEndpoint = '';
         if (useTls) {
@@ -997,6 +1074,9 @@ const GASP_proto = {
         } else {
             wsEndpoint = 'ws://' + serverSocket + '/gaspws';
         }
+        if (this.getConfig().csrf_token) {
+            wsEndpoint += '?csrf_token=' + encodeURIComponent(this.getConfig().csrf_token);
+        }
 
         this.socket = new WebSocket(wsEndpoint);
 
@@ -1008,42 +1088,14 @@ const GASP_proto = {
             console.log('Gasp: disconnected from server');
         };
 
+        this.socket.binaryType = 'arraybuffer';
+
         this.socket.onmessage = msg => {
-            let evt = JSON.parse(msg.data);
-            switch (evt.type) {
-                case 'form_update':
-                    this.updateFormState(evt.data.state);
-                    break;
-                case 'textbox_update':
-                    this.updateTextbox(evt.data);
-                    break;
-                case 'button_update':
-                    this.updateButton(evt.data);
-                    break;
-                case 'label_update':
-                    this.updateLabel(evt.data);
-                    break;
-                case 'dropdown_update':
-                    this.updateDropdown(evt.data);
-                    break;
-                case 'checkbox_update':
-                    this.updateCheckbox(evt.data);
-                    break;
-                case 'linechart_update':
-                    this.updateLineChart(evt.data);
-                    break;
-                case 'packetinspector_update':
-                    this.updatePacketInspector(evt.data);
-                    break;
-                default:
-                    if (this.serverEventHandlers) {
-                        if (this.serverEventHandlers[evt.type]) {
-                            for (let i = 0; i < this.serverEventHandlers[evt.type].length; i++) {
-                                this.serverEventHandlers[evt.type][i](evt);
-                            }
-                        }
-                    }
-                    break;
+            let evt = (msg.data instanceof ArrayBuffer) ? this.decodeBinaryMessage(msg.data) : JSON.parse(msg.data);
+            if (Array.isArray(evt)) {
+                evt.forEach(e => this.handleServerEvent(e));
+            } else {
+                this.handleServerEvent(evt);
             }
         };
 
@@ -1051,11 +1103,103 @@ const GASP_proto = {
             console.log('Gasp: error: ' + JSON.stringify(err));
         };
     },
+    decodeBinaryMessage(buffer) {
+        let view = new DataView(buffer);
+        let headerLength = view.getUint32(1, false);
+        let header = JSON.parse(new TextDecoder().decode(new Uint8Array(buffer, 5, headerLength)));
+        let offset = 5 + headerLength;
+
+        for (let i = 0; i < header.attachments.length; i++) {
+            let attachment = header.attachments[i];
+            let value = null;
+            switch (attachment.kind) {
+                case 'u8':
+                    value = new Uint8Array(buffer.slice(offset, offset + attachment.length));
+                    offset += attachment.length;
+                    break;
+                case 'f64':
+                    value = new Float64Array(attachment.length);
+                    for (let j = 0; j < attachment.length; j++) {
+                        value[j] = view.getFloat64(offset, true);
+                        offset += 8;
+                    }
+                    break;
+            }
+
+            let target = header.payload;
+            for (let j = 0; j < attachment.path.length - 1; j++) {
+                target = target[attachment.path[j]];
+            }
+            target[attachment.path[attachment.path.length - 1]] = value;
+        }
+
+        return header.payload;
+    },
+    handleServerEvent(evt) {
+        switch (evt.type) {
+            case 'form_update':
+                this.updateFormState(evt.data.state);
+                break;
+            case 'textbox_update':
+                this.updateTextbox(evt.data);
+                break;
+            case 'button_update':
+                this.updateButton(evt.data);
+                break;
+            case 'label_update':
+                this.updateLabel(evt.data);
+                break;
+            case 'dropdown_update':
+                this.updateDropdown(evt.data);
+                break;
+            case 'checkbox_update':
+                this.updateCheckbox(evt.data);
+                break;
+            case 'linechart_update':
+                this.updateLineChart(evt.data);
+                break;
+            case 'packetinspector_update':
+                this.updatePacketInspector(evt.data);
+                break;
+            case 'fragment_update':
+                this.updateFragment(evt.data);
+                this.invokeServerEventHandlers(evt);
+                break;
+            case 'reload':
+                this.invokeServerEventHandlers(evt);
+                this.reload(evt.data);
+                break;
+            case 'ws_info':
+                if (evt.data && evt.data.client_id) {
+                    this.clientId = evt.data.client_id;
+                }
+                this.invokeServerEventHandlers(evt);
+                break;
+            case 'handler_error':
+                console.log('Gasp: ' + evt.text);
+                this.invokeServerEventHandlers(evt);
+                break;
+            default:
+                this.invokeServerEventHandlers(evt);
+                break;
+        }
+    },
+    getConfig() {
+        if (!this.config) {
+            let configElement = document.getElementById('gasp-config');
+            this.config = configElement ? JSON.parse(configElement.textContent) : {};
+        }
+        return this.config;
+    },
     init(uri) {
         if (this.initiated) {
             return;
         }
 
+        if (uri === undefined) {
+            uri = this.getConfig().server_socket;
+        }
+
         this.initControls();
         this.initComm(uri);
 
@@ -1064,3 +1208,9 @@ const GASP_proto = {
 }
 
 let GASP = Object.create(GASP_proto);
+
+document.addEventListener('DOMContentLoaded', () => {
+    if (document.body && document.body.dataset.gaspInit !== undefined) {
+        GASP.init();
+    }
+});
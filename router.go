@@ -0,0 +1,377 @@
+package gasp
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	regexPatternPrefix = "re:"
+)
+
+type EventHandler func(event *ClientEvent)
+
+type EventMiddleware func(next EventHandler) EventHandler
+
+// Patterns are literals, globs ('*', '?') or regular expressions prefixed with "re:".
+// Higher priorities run first, then more specific routes, then registration order.
+type EventRoute struct {
+	View     string
+	Id       string
+	Type     string
+	Priority int
+	Handler  EventHandler
+}
+
+type eventPattern struct {
+	literal string
+	regex   *regexp.Regexp
+}
+
+type eventRouteEntry struct {
+	route       EventRoute
+	view        *eventPattern
+	id          *eventPattern
+	eventType   *eventPattern
+	specificity int
+	order       int
+}
+
+type eventRouter struct {
+	mutex       sync.RWMutex
+	routes      []*eventRouteEntry
+	middleware  []EventMiddleware
+	handled     []string
+	onPanic     func(event *ClientEvent, recovered interface{}, stack []byte)
+	poolMutex   sync.Mutex
+	workerCount int
+	queueSize   int
+	pool        *eventWorkerPool
+}
+
+type eventWorkerPool struct {
+	queue     chan *ClientEvent
+	done      chan struct{}
+	waitGroup sync.WaitGroup
+}
+
+func newEventRouter(onPanic func(event *ClientEvent, recovered interface{}, stack []byte)) *eventRouter {
+	return &eventRouter{onPanic: onPanic}
+}
+
+func newEventPattern(pattern string) (*eventPattern, error) {
+	pattern = strings.TrimSpace(pattern)
+
+	if pattern == "" || pattern == "*" {
+		return &eventPattern{}, nil
+	}
+
+	if strings.HasPrefix(pattern, regexPatternPrefix) {
+		regex, err := regexp.Compile(strings.TrimPrefix(pattern, regexPatternPrefix))
+		if err != nil {
+			return nil, fmt.Errorf("invalid event pattern '%s': %v", pattern, err)
+		}
+		return &eventPattern{regex: regex}, nil
+	}
+
+	if !strings.ContainsAny(pattern, "*?") {
+		return &eventPattern{literal: pattern}, nil
+	}
+
+	expr := "^"
+	for _, r := range pattern {
+		switch r {
+		case '*':
+			expr += ".*"
+		case '?':
+			expr += "."
+		default:
+			expr += regexp.QuoteMeta(string(r))
+		}
+	}
+	expr += "$"
+
+	return &eventPattern{regex: regexp.MustCompile(expr)}, nil
+}
+
+func (pattern *eventPattern) isLiteral() bool {
+	return pattern.literal != ""
+}
+
+func (pattern *eventPattern) specificity() int {
+	if pattern.literal != "" {
+		return 2
+	}
+	if pattern.regex != nil {
+		return 1
+	}
+	return 0
+}
+
+func (pattern *eventPattern) matches(value string) bool {
+	if pattern.regex != nil {
+		return pattern.regex.MatchString(value)
+	}
+	if pattern.literal != "" {
+		return pattern.literal == value
+	}
+	return true
+}
+
+func (router *eventRouter) addRoute(route EventRoute) error {
+	if route.Handler == nil {
+		return errors.New("event route handler cannot be nil")
+	}
+
+	view, err := newEventPattern(route.View)
+	if err != nil {
+		return err
+	}
+
+	id, err := newEventPattern(route.Id)
+	if err != nil {
+		return err
+	}
+
+	eventType, err := newEventPattern(route.Type)
+	if err != nil {
+		return err
+	}
+
+	entry := eventRouteEntry{
+		route:       route,
+		view:        view,
+		id:          id,
+		eventType:   eventType,
+		specificity: id.specificity()*3 + view.specificity(),
+	}
+
+	router.mutex.Lock()
+	defer router.mutex.Unlock()
+
+	entry.order = len(router.routes)
+	router.routes = append(router.routes, &entry)
+	router.handled = nil
+	sort.SliceStable(router.routes, func(i, j int) bool {
+		a, b := router.routes[i], router.routes[j]
+		if a.route.Priority != b.route.Priority {
+			return a.route.Priority > b.route.Priority
+		}
+		if a.specificity != b.specificity {
+			return a.specificity > b.specificity
+		}
+		return a.order < b.order
+	})
+
+	return nil
+}
+
+func (router *eventRouter) use(middleware ...EventMiddleware) {
+	router.mutex.Lock()
+	defer router.mutex.Unlock()
+
+	for _, m := range middleware {
+		if m != nil {
+			router.middleware = append(router.middleware, m)
+		}
+	}
+}
+
+func (router *eventRouter) handledEvents() []string {
+	router.mutex.RLock()
+	handled := router.handled
+	router.mutex.RUnlock()
+
+	if handled != nil {
+		return handled
+	}
+
+	router.mutex.Lock()
+	defer router.mutex.Unlock()
+
+	handledEvents := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, entry := range router.routes {
+		if !entry.eventType.isLiteral() {
+			continue
+		}
+
+		view := "*"
+		if entry.view.isLiteral() {
+			view = entry.view.literal
+		}
+
+		id := strings.TrimSpace(entry.route.Id)
+		if id == "" {
+			id = "*"
+		}
+
+		event := view + "#" + id + "!" + entry.eventType.literal
+		if !seen[event] {
+			seen[event] = true
+			handledEvents = append(handledEvents, event)
+		}
+	}
+
+	router.handled = handledEvents
+	return handledEvents
+}
+
+func (router *eventRouter) dispatch(event *ClientEvent) {
+	router.mutex.RLock()
+	handlers := make([]EventHandler, 0)
+	for _, entry := range router.routes {
+		if entry.view.matches(event.View) && entry.id.matches(event.Id) && entry.eventType.matches(event.Type) {
+			handlers = append(handlers, entry.route.Handler)
+		}
+	}
+	middleware := router.middleware
+	router.mutex.RUnlock()
+
+	if len(handlers) == 0 {
+		return
+	}
+
+	var handler EventHandler = func(event *ClientEvent) {
+		for _, h := range handlers {
+			if event.IsPropagationStopped() {
+				return
+			}
+			router.invoke(h, event)
+		}
+	}
+
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+
+	router.invoke(handler, event)
+}
+
+func (router *eventRouter) invoke(handler EventHandler, event *ClientEvent) {
+	defer func() {
+		if r := recover(); r != nil && router.onPanic != nil {
+			router.onPanic(event, r, debug.Stack())
+		}
+	}()
+	handler(event)
+}
+
+func (router *eventRouter) setWorkers(workerCount int, queueSize int) {
+	router.poolMutex.Lock()
+	defer router.poolMutex.Unlock()
+
+	if workerCount < 0 {
+		workerCount = 0
+	}
+	if queueSize < 1 {
+		queueSize = workerCount
+	}
+
+	router.workerCount = workerCount
+	router.queueSize = queueSize
+}
+
+func (router *eventRouter) start() {
+	router.poolMutex.Lock()
+	defer router.poolMutex.Unlock()
+
+	if router.workerCount == 0 || router.pool != nil {
+		return
+	}
+
+	pool := eventWorkerPool{
+		queue: make(chan *ClientEvent, router.queueSize),
+		done:  make(chan struct{}),
+	}
+
+	for i := 0; i < router.workerCount; i++ {
+		pool.waitGroup.Add(1)
+		go func() {
+			defer pool.waitGroup.Done()
+			for {
+				select {
+				case <-pool.done:
+					return
+				case event := <-pool.queue:
+					router.dispatch(event)
+				}
+			}
+		}()
+	}
+
+	router.pool = &pool
+}
+
+func (router *eventRouter) stop() {
+	router.poolMutex.Lock()
+	pool := router.pool
+	router.pool = nil
+	router.poolMutex.Unlock()
+
+	if pool != nil {
+		close(pool.done)
+		pool.waitGroup.Wait()
+	}
+}
+
+// submit hands the event to the worker pool if one is running, blocking while
+// its queue is full, otherwise the event is dispatched on the caller's goroutine.
+func (router *eventRouter) submit(event *ClientEvent) {
+	router.poolMutex.Lock()
+	pool := router.pool
+	router.poolMutex.Unlock()
+
+	if pool == nil {
+		router.dispatch(event)
+		return
+	}
+
+	select {
+	case pool.queue <- event:
+	case <-pool.done:
+	}
+}
+
+func LogEvents(logger *log.Logger) EventMiddleware {
+	if logger == nil {
+		logger = log.Default()
+	}
+
+	return func(next EventHandler) EventHandler {
+		return func(event *ClientEvent) {
+			logger.Printf("gasp: event received: view='%s' id='%s' type='%s'", event.View, event.Id, event.Type)
+			next(event)
+		}
+	}
+}
+
+func RecoverEvents(onPanic func(event *ClientEvent, recovered interface{})) EventMiddleware {
+	return func(next EventHandler) EventHandler {
+		return func(event *ClientEvent) {
+			defer func() {
+				if r := recover(); r != nil && onPanic != nil {
+					onPanic(event, r)
+				}
+			}()
+			next(event)
+		}
+	}
+}
+
+func AuthorizeEvents(authorize func(event *ClientEvent) bool) EventMiddleware {
+	return func(next EventHandler) EventHandler {
+		return func(event *ClientEvent) {
+			if authorize != nil && !authorize(event) {
+				return
+			}
+			next(event)
+		}
+	}
+}
@@ -0,0 +1,351 @@
+package gasp
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	routeMethodRegex    = regexp.MustCompile(`^[A-Z]+$`)
+	routeParamNameRegex = regexp.MustCompile(`^[A-Za-z_][\w]*$`)
+)
+
+type routeParamsKey struct{}
+
+// Route patterns are paths that may start with a method ("POST /devices") and
+// contain parameters ("/devices/{id}"), the last of which can match the rest of
+// the path ("/files/{path...}").  As with http.ServeMux, a pattern ending with
+// a slash matches the whole subtree and the most specific pattern wins.
+type routePattern struct {
+	text     string
+	method   string
+	segments []routeSegment
+	subtree  bool
+}
+
+type routeSegment struct {
+	literal  string
+	param    string
+	wildcard bool
+}
+
+type routeEntry struct {
+	pattern  *routePattern
+	handler  http.Handler
+	internal bool
+}
+
+type routeTable struct {
+	mutex  sync.RWMutex
+	routes []*routeEntry
+}
+
+func RouteParams(req *http.Request) map[string]string {
+	params, _ := req.Context().Value(routeParamsKey{}).(map[string]string)
+	return params
+}
+
+func RouteParam(req *http.Request, name string) string {
+	return RouteParams(req)[name]
+}
+
+func parseRoutePattern(pattern string) (*routePattern, error) {
+	pattern = strings.TrimSpace(pattern)
+
+	method := ""
+	if i := strings.IndexAny(pattern, " \t"); i >= 0 && routeMethodRegex.MatchString(pattern[:i]) {
+		method = pattern[:i]
+		pattern = strings.TrimSpace(pattern[i:])
+	}
+
+	if pattern == "" {
+		pattern = "/"
+	}
+
+	if pattern[:1] != "/" {
+		pattern = "/" + pattern
+	}
+
+	routePattern := routePattern{
+		method:  method,
+		subtree: strings.HasSuffix(pattern, "/"),
+	}
+
+	routePattern.text = pattern
+	if method != "" {
+		routePattern.text = method + " " + pattern
+	}
+
+	trimmed := strings.Trim(pattern, "/")
+	if trimmed == "" {
+		return &routePattern, nil
+	}
+
+	seenParams := make(map[string]bool)
+	parts := strings.Split(trimmed, "/")
+	for i, part := range parts {
+		if !strings.HasPrefix(part, "{") || !strings.HasSuffix(part, "}") {
+			if strings.ContainsAny(part, "{}") {
+				return nil, fmt.Errorf("invalid route pattern '%s'", pattern)
+			}
+			routePattern.segments = append(routePattern.segments, routeSegment{literal: part})
+			continue
+		}
+
+		name := part[1 : len(part)-1]
+		segment := routeSegment{}
+		if strings.HasSuffix(name, "...") {
+			if i != len(parts)-1 || routePattern.subtree {
+				return nil, fmt.Errorf("invalid route pattern '%s', '{%s}' must be the last segment", pattern, name)
+			}
+			name = strings.TrimSuffix(name, "...")
+			segment.wildcard = true
+		}
+
+		if !routeParamNameRegex.MatchString(name) || seenParams[name] {
+			return nil, fmt.Errorf("invalid route pattern '%s', bad parameter name '%s'", pattern, name)
+		}
+		seenParams[name] = true
+
+		segment.param = name
+		routePattern.segments = append(routePattern.segments, segment)
+	}
+
+	return &routePattern, nil
+}
+
+func (pattern *routePattern) path() string {
+	if pattern.method == "" {
+		return pattern.text
+	}
+	return strings.TrimPrefix(pattern.text, pattern.method+" ")
+}
+
+func (pattern *routePattern) allowsMethod(method string) bool {
+	return pattern.method == "" || pattern.method == method || (pattern.method == http.MethodGet && method == http.MethodHead)
+}
+
+func (pattern *routePattern) match(path string) (map[string]string, bool) {
+	parts := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	if len(pattern.segments) == 0 {
+		return nil, pattern.subtree || path == "/"
+	}
+
+	var params map[string]string
+	for i, segment := range pattern.segments {
+		if i >= len(parts) {
+			return nil, false
+		}
+
+		switch {
+		case segment.wildcard:
+			if params == nil {
+				params = make(map[string]string)
+			}
+			params[segment.param] = strings.Join(parts[i:], "/")
+			return params, true
+		case segment.param != "":
+			if parts[i] == "" {
+				return nil, false
+			}
+			if params == nil {
+				params = make(map[string]string)
+			}
+			params[segment.param] = parts[i]
+		case segment.literal != parts[i]:
+			return nil, false
+		}
+	}
+
+	remaining := len(parts) - len(pattern.segments)
+	if pattern.subtree {
+		return params, remaining > 0
+	}
+	return params, remaining == 0
+}
+
+// moreSpecific compares patterns segment by segment, where literals beat
+// parameters, which beat wildcards, which beat the end of a subtree pattern.
+func (pattern *routePattern) moreSpecific(other *routePattern) bool {
+	a, b := pattern.ranks(), other.ranks()
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			return a[i] > b[i]
+		}
+	}
+	if len(a) != len(b) {
+		return len(a) > len(b)
+	}
+	return pattern.method != "" && other.method == ""
+}
+
+func (pattern *routePattern) ranks() []int {
+	ranks := make([]int, 0, len(pattern.segments)+1)
+	for _, segment := range pattern.segments {
+		switch {
+		case segment.wildcard:
+			ranks = append(ranks, 1)
+		case segment.param != "":
+			ranks = append(ranks, 2)
+		default:
+			ranks = append(ranks, 3)
+		}
+	}
+	if pattern.subtree {
+		ranks = append(ranks, 0)
+	}
+	return ranks
+}
+
+func (table *routeTable) add(entry *routeEntry) error {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+
+	for _, e := range table.routes {
+		if e.pattern.text == entry.pattern.text {
+			return fmt.Errorf("path '%s' already handled", entry.pattern.text)
+		}
+	}
+
+	table.routes = append(table.routes, entry)
+	sort.SliceStable(table.routes, func(i, j int) bool {
+		return table.routes[i].pattern.moreSpecific(table.routes[j].pattern)
+	})
+	return nil
+}
+
+func (table *routeTable) has(pattern string) bool {
+	table.mutex.RLock()
+	defer table.mutex.RUnlock()
+
+	for _, entry := range table.routes {
+		if entry.pattern.text == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+func (table *routeTable) count() int {
+	table.mutex.RLock()
+	defer table.mutex.RUnlock()
+	return len(table.routes)
+}
+
+// lookup returns the most specific route matching the path and method, or if the
+// path only matches routes for other methods, the methods that are allowed.
+func (table *routeTable) lookup(method string, path string) (*routeEntry, map[string]string, []string) {
+	table.mutex.RLock()
+	defer table.mutex.RUnlock()
+
+	allowed := make([]string, 0)
+	for _, entry := range table.routes {
+		params, ok := entry.pattern.match(path)
+		if !ok {
+			continue
+		}
+		if entry.pattern.allowsMethod(method) {
+			return entry, params, nil
+		}
+		allowed = append(allowed, entry.pattern.method)
+	}
+	return nil, nil, allowed
+}
+
+func (server *Server) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	server.getHandler().ServeHTTP(rw, req)
+}
+
+func (server *Server) route(rw http.ResponseWriter, req *http.Request) {
+	var entry *routeEntry
+	var params map[string]string
+	var allowed []string
+
+	req, ok := server.authenticate(rw, req)
+	if !ok {
+		return
+	}
+
+	for rewrites := 0; ; rewrites++ {
+		entry, params, allowed = server.routes.lookup(req.Method, req.URL.Path)
+		if entry == nil || entry.internal {
+			break
+		}
+
+		decision := server.applyGuards(req)
+		if decision.action == guardAllow {
+			break
+		}
+
+		if decision.action != guardRewrite {
+			decision.apply(rw, req)
+			return
+		}
+
+		if rewrites == maxRewrites {
+			http.Error(rw, "too many rewrites", http.StatusInternalServerError)
+			server.sendError(ErrorSourceView, fmt.Errorf("too many rewrites for path '%s'", req.URL.Path))
+			return
+		}
+
+		path := decision.path
+		if !strings.HasPrefix(path, "/") {
+			path = "/" + path
+		}
+
+		rewritten := req.Clone(req.Context())
+		rewritten.URL.Path = path
+		rewritten.URL.RawPath = ""
+		req = rewritten
+	}
+
+	if entry == nil {
+		if len(allowed) > 0 {
+			rw.Header().Set("Allow", strings.Join(allowed, ", "))
+			http.Error(rw, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		if !strings.HasSuffix(req.URL.Path, "/") {
+			if subtree, _, _ := server.routes.lookup(req.Method, req.URL.Path+"/"); subtree != nil && subtree.pattern.subtree {
+				url := *req.URL
+				url.Path += "/"
+				http.Redirect(rw, req, url.String(), http.StatusMovedPermanently)
+				return
+			}
+		}
+
+		http.NotFound(rw, req)
+		return
+	}
+
+	if params != nil {
+		req = withRouteParams(req, params)
+	}
+	entry.handler.ServeHTTP(rw, req)
+}
+
+func withRouteParams(req *http.Request, params map[string]string) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), routeParamsKey{}, params))
+}
+
+func (server *Server) addRoute(path string, handler http.Handler) error {
+	pattern, err := server.validateNewPath(path)
+	if err != nil {
+		return err
+	}
+	return server.routes.add(&routeEntry{pattern: pattern, handler: handler})
+}
+
+func (server *Server) viewParams(view string) map[string]string {
+	entry, params, _ := server.routes.lookup(http.MethodGet, "/"+view)
+	if entry == nil {
+		return nil
+	}
+	return params
+}
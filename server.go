@@ -1,124 +1,200 @@
 package gasp
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/gorilla/websocket"
+	"html/template"
+	"io/fs"
+	"log/slog"
 	"net"
 	"net/http"
-	"os"
-	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+const (
+	errorChanSize  = 100
+	websocketsPath = "/gaspws"
+)
+
 type Server struct {
-	commSocket    string
-	httpServer    *http.Server
-	handledPaths  []string
-	guardedPaths  map[string]func(req *http.Request) (newPath *string)
-	eventHandlers map[string][]func(event *ClientEvent)
-	eventChan     chan *ServerEvent
-	varSetters    map[string]func(req *http.Request) string
-	resources     map[string][]byte
-	form          *Form
-	useTls        bool
+	commSocket       string
+	clientSocket     atomic.Value
+	httpServer       *http.Server
+	routes           routeTable
+	guards           []*routeGuard
+	publicPaths      []*routePattern
+	authorizations   []*eventAuthorization
+	audit            auditConfig
+	middleware       []Middleware
+	middlewareMutex  sync.Mutex
+	handler          http.Handler
+	eventRouter      *eventRouter
+	clients          map[string]*client
+	clientsMutex     sync.RWMutex
+	queueCounters    queueCounters
+	throttleCounters throttleCounters
+	varSetters       map[string]func(req *http.Request) string
+	fragments        map[string]*fragment
+	layouts          map[string]string
+	watcher          *fileWatcher
+	resources        map[string][]byte
+	form             *Form
+	useTls           bool
+	options          ServerOptions
+	csrfSecret       []byte
 
 	ErrorChan chan error
 }
 
+type ServerOptions struct {
+	NotifyClientOnHandlerError bool
+	OnError                    func(err *Error)
+	Logger                     *slog.Logger
+	ReportBenignErrors         bool
+	QueueSize                  int
+	QueuePolicy                QueuePolicy
+	MaxBatchSize               int
+	DisableCoalescing          bool
+	MessageFormat              MessageFormat
+	EnableCompression          bool
+	InlineAssets               bool
+	DevMode                    bool
+	WatchInterval              time.Duration
+	Sessions                   SessionOptions
+	Auth                       AuthOptions
+	AllowedOrigins             []string
+	DisableCsrfToken           bool
+	CsrfTokenMaxAge            time.Duration
+	DevCertificateDir          string
+	Listener                   net.Listener
+	MaxMessageSize             int64
+	RateLimit                  RateLimit
+	EventRateLimits            map[string]RateLimit
+	IdleTimeout                time.Duration
+	PingInterval               time.Duration
+	Audit                      AuditOptions
+}
+
 func NewServer(socket string, form ...*Form) (*Server, error) {
-	server := Server{}
+	return NewServerWithOptions(socket, ServerOptions{}, form...)
+}
+
+func NewServerWithOptions(socket string, options ServerOptions, form ...*Form) (*Server, error) {
+	server := Server{options: options}
+
+	if socket == "" && options.Listener != nil {
+		socket = options.Listener.Addr().String()
+		if options.Listener.Addr().Network() == "unix" {
+			socket = unixSocketPrefix + socket
+		}
+	}
 
 	err := ValidateSocket(socket)
 	if err != nil {
 		return nil, err
 	}
+
+	err = server.initSessions()
+	if err != nil {
+		return nil, err
+	}
+
+	err = server.initAuth()
+	if err != nil {
+		return nil, err
+	}
+
+	err = server.initCsrf()
+	if err != nil {
+		return nil, err
+	}
+
+	err = server.initAudit()
+	if err != nil {
+		return nil, err
+	}
 	server.commSocket = socket
+	server.clientSocket.Store(getClientSocket(socket, nil))
 
-	server.guardedPaths = make(map[string]func(req *http.Request) (newPath *string))
-	server.eventHandlers = make(map[string][]func(event *ClientEvent))
-	server.eventChan = make(chan *ServerEvent, 10000)
+	server.eventRouter = newEventRouter(server.handlePanic)
+	server.clients = make(map[string]*client)
 	server.varSetters = make(map[string]func(req *http.Request) string)
+	server.fragments = make(map[string]*fragment)
+	server.layouts = make(map[string]string)
+	server.watcher = newFileWatcher(options.WatchInterval)
 
 	if form != nil && len(form) > 0 {
 		server.form = form[0]
 	}
 
-	server.ErrorChan = make(chan error)
+	server.ErrorChan = make(chan error, errorChanSize)
 
 	return &server, nil
 }
 
 func (server *Server) Build() error {
-	if len(server.handledPaths) == 0 {
+	if server.routes.count() == 0 {
 		server.addDefaultHandler()
 	}
 
 	server.addWebsocketsHandler()
+	server.addAssetHandlers()
 	return nil
 }
 
 func (server *Server) Start() error {
-	err := server.Build()
-	if err != nil {
-		return err
-	}
-
-	go func() {
-		listener, err := net.Listen("tcp", server.commSocket)
-		if err != nil {
-			server.sendError(err)
-			return
-		}
-		defer func(listener net.Listener) {
-			err := listener.Close()
-			if err != nil {
-				server.sendError(err)
-				return
-			}
-		}(listener)
-
-		server.httpServer = &http.Server{}
-		err = server.httpServer.Serve(listener)
-		if err != nil {
-			server.sendError(err)
-			server.httpServer = nil
-			return
-		}
-	}()
-
-	time.Sleep(time.Second)
-	return nil
+	return server.start(func(httpServer *http.Server, listener net.Listener) error {
+		return httpServer.Serve(listener)
+	})
 }
 
 func (server *Server) StartWithTLS(certFile string, keyFile string) error {
 	server.useTls = true
+	return server.start(func(httpServer *http.Server, listener net.Listener) error {
+		return httpServer.ServeTLS(listener, certFile, keyFile)
+	})
+}
 
+func (server *Server) start(serve func(httpServer *http.Server, listener net.Listener) error) error {
 	err := server.Build()
 	if err != nil {
 		return err
 	}
 
-	go func() {
-		listener, err := net.Listen("tcp", server.commSocket)
+	listener := server.options.Listener
+	if listener == nil {
+		listener, err = listen(server.commSocket)
 		if err != nil {
-			server.sendError(err)
-			return
+			return err
 		}
+	}
+	server.clientSocket.Store(getClientSocket(server.commSocket, listener.Addr()))
+
+	server.eventRouter.start()
+
+	if server.options.DevMode {
+		server.watcher.start()
+	}
+
+	go func() {
 		defer func(listener net.Listener) {
 			err := listener.Close()
 			if err != nil {
-				server.sendError(err)
+				server.sendError(ErrorSourceListener, err)
 				return
 			}
 		}(listener)
 
-		server.httpServer = &http.Server{}
-		err = server.httpServer.ServeTLS(listener, certFile, keyFile)
+		server.httpServer = &http.Server{Handler: server}
+		err := serve(server.httpServer, listener)
 		if err != nil {
-			server.sendError(err)
+			server.sendError(ErrorSourceListener, err)
 			server.httpServer = nil
 			return
 		}
@@ -128,7 +204,30 @@ func (server *Server) StartWithTLS(certFile string, keyFile string) error {
 	return nil
 }
 
+// GetUri returns the URI clients use to reach the path, which is an http+unix URI
+// for servers listening on a Unix domain socket.
+func (server *Server) GetUri(path string) string {
+	return getBaseUri(server.commSocket, server.getClientSocket(), server.useTls) + strings.TrimPrefix(path, "/")
+}
+
+func (server *Server) getClientSocket() string {
+	return server.clientSocket.Load().(string)
+}
+
+// getViewSocket returns the WebSockets address used by views, which is empty when the
+// client socket has no host so that the page's own host is used instead.
+func (server *Server) getViewSocket() string {
+	clientSocket := server.getClientSocket()
+	if strings.HasPrefix(clientSocket, ":") {
+		return ""
+	}
+	return clientSocket
+}
+
 func (server *Server) Stop() error {
+	defer server.eventRouter.stop()
+	defer server.watcher.stop()
+
 	if server.httpServer != nil {
 		err := server.httpServer.Close()
 		if err != nil {
@@ -139,129 +238,203 @@ func (server *Server) Stop() error {
 }
 
 func (server *Server) SendEvent(event *ServerEvent) {
-	select {
-	case server.eventChan <- event:
-	default:
+	for _, c := range server.getClients() {
+		server.enqueueEvent(c, event)
 	}
 }
 
-func (server *Server) AddResources(directory string, excludedFileExtensions ...string) error {
-	if strings.TrimSpace(directory) == "" {
-		return errors.New("parameter 'directory' cannot be empty/whitespace")
+func (server *Server) SendEventToClient(clientId string, event *ServerEvent) error {
+	server.clientsMutex.RLock()
+	c, ok := server.clients[clientId]
+	server.clientsMutex.RUnlock()
+
+	if !ok {
+		return fmt.Errorf("client '%s' is not connected", clientId)
+	}
+
+	server.enqueueEvent(c, event)
+	return nil
+}
+
+func (server *Server) QueueStats() QueueStats {
+	return QueueStats{
+		Dropped:      server.queueCounters.dropped.Load(),
+		Coalesced:    server.queueCounters.coalesced.Load(),
+		Disconnected: server.queueCounters.disconnected.Load(),
+		Batches:      server.queueCounters.batches.Load(),
 	}
+}
+
+func (server *Server) AddResources(directory string, excludedFileExtensions ...string) error {
+	return server.AddResourcesWithOptions(directory, ResourceOptions{ExcludedFileExtensions: excludedFileExtensions})
+}
+
+func (server *Server) AddResourcesFS(prefix string, fsys fs.FS, excludedFileExtensions ...string) error {
+	return server.AddResourcesFSWithOptions(prefix, fsys, ResourceOptions{ExcludedFileExtensions: excludedFileExtensions})
+}
+
+func (server *Server) AddRouteHandler(path string, handler func(http.ResponseWriter, *http.Request)) error {
+	return server.addRoute(path, http.HandlerFunc(handler))
+}
 
-	dirInfo, err := os.Stat(directory)
-	if err != nil && errors.Is(err, os.ErrNotExist) {
-		return fmt.Errorf("resources directory '%s' does not exist", directory)
+func (server *Server) AddView(path string, html string) error {
+	_, err := server.addView(path, html)
+	return err
+}
+
+func (server *Server) AddViewFS(path string, fsys fs.FS, name string) error {
+	if fsys == nil {
+		return errors.New("parameter 'fsys' cannot be nil")
 	}
 
-	if !dirInfo.IsDir() {
-		return fmt.Errorf("'%s' is not a directory", directory)
+	html, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		return fmt.Errorf("failed to read view '%s': %v", name, err)
 	}
 
-	if directory[len(directory)-1:] != "/" {
-		directory += "/"
+	view, err := server.addView(path, string(html))
+	if err != nil {
+		return err
 	}
 
-	err = filepath.Walk(directory, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		if !info.IsDir() {
-			for _, ext := range excludedFileExtensions {
-				if strings.HasSuffix(info.Name(), ext) {
-					return nil
-				}
+	if server.options.DevMode {
+		server.watcher.watch(fsys, name, func() {
+			html, err := fs.ReadFile(fsys, name)
+			if err != nil {
+				server.sendError(ErrorSourceView, err)
+				return
 			}
-			resourceContents, err := os.ReadFile(path)
+
+			updatedHtml, err := server.applyLayouts(string(html))
 			if err != nil {
-				return err
+				server.sendError(ErrorSourceView, err)
+				return
 			}
-			urlPath := strings.Replace(path, directory, "", 1)
-			return server.AddRouteHandler(urlPath, func(rw http.ResponseWriter, req *http.Request) {
-				_, err := rw.Write(resourceContents)
+
+			view.Store(CompileView(updatedHtml))
+			server.sendReloadEvent("page", "")
+		})
+	}
+
+	return nil
+}
+
+func (server *Server) addView(path string, html string) (*atomic.Pointer[CompiledView], error) {
+	html, err := server.applyLayouts(html)
+	if err != nil {
+		return nil, err
+	}
+
+	view := atomic.Pointer[CompiledView]{}
+	view.Store(CompileView(html))
+
+	handler := func(rw http.ResponseWriter, req *http.Request) {
+		view := view.Load()
+		vars := map[string]string{"server_socket": server.getViewSocket()}
+		for _, varName := range view.Variables() {
+			if setter, ok := server.varSetters[varName]; ok {
+				vars[varName] = setter(req)
+			} else if strings.HasPrefix(varName, authorizeVariablePrefix) {
+				vars[varName] = server.renderAuthorization(varName, req)
+			} else if strings.HasPrefix(varName, fragmentVariablePrefix) {
+				html, err := server.renderFragment(strings.TrimPrefix(varName, fragmentVariablePrefix), req)
 				if err != nil {
-					rw.WriteHeader(http.StatusInternalServerError)
-					server.ErrorChan <- err
+					server.sendError(ErrorSourceView, err)
+					continue
 				}
-			})
+				vars[varName] = string(html)
+			}
 		}
 
-		return nil
-	})
-	if err != nil {
-		return fmt.Errorf("failed to add resources directory: %v", err)
+		_, err := rw.Write([]byte(view.RenderWithConfig(vars, server.getViewConfig(req))))
+		if err != nil {
+			server.sendError(ErrorSourceView, err)
+		}
 	}
 
-	return nil
+	err = server.addRoute(path, http.HandlerFunc(handler))
+	if err != nil {
+		return nil, err
+	}
+	return &view, nil
 }
 
-func (server *Server) AddRouteHandler(path string, handler func(http.ResponseWriter, *http.Request)) error {
-	updatedPath, err := server.validateNewPath(path)
-	if err != nil {
-		return err
+func (server *Server) sendReloadEvent(kind string, path string) {
+	data := map[string]interface{}{"kind": kind}
+	if path != "" {
+		data["path"] = path
 	}
 
-	http.HandleFunc(updatedPath, handler)
-	server.handledPaths = append(server.handledPaths, updatedPath)
-	return nil
+	server.SendEvent(&ServerEvent{
+		Type: "reload",
+		Text: "content has changed server-side",
+		Data: data,
+	})
 }
 
-func (server *Server) AddView(path string, html string) error {
-	updatedPath, err := server.validateNewPath(path)
-	if err != nil {
-		return err
+func (server *Server) AddTemplateView(path string, tmpl *template.Template, dataFunc func(req *http.Request) any) error {
+	if tmpl == nil {
+		return errors.New("parameter 'tmpl' cannot be nil")
 	}
 
-	vars := map[string]string{"server_socket": server.commSocket}
 	handler := func(rw http.ResponseWriter, req *http.Request) {
-		if guardFunc, ok := server.guardedPaths[updatedPath]; ok {
-			newPath := guardFunc(req)
-			if newPath != nil {
-				if (*newPath)[:1] != "/" {
-					*newPath = "/" + *newPath
-				}
-				http.Redirect(rw, req, "http://"+server.commSocket+*newPath, http.StatusFound)
-			}
+		view, err := tmpl.Clone()
+		if err != nil {
+			rw.WriteHeader(http.StatusInternalServerError)
+			server.sendError(ErrorSourceView, err)
+			return
 		}
+		view.Funcs(server.getTemplateFuncs(req))
 
-		handledEvents := make([]string, 0)
-		for event := range server.eventHandlers {
-			handledEvents = append(handledEvents, event)
+		var data any
+		if dataFunc != nil {
+			data = dataFunc(req)
 		}
 
-		for varName, setter := range server.varSetters {
-			if strings.Contains(html, "<!--"+varName+"-->") {
-				vars[varName] = setter(req)
-			}
+		buffer := bytes.Buffer{}
+		err = view.Execute(&buffer, data)
+		if err != nil {
+			rw.WriteHeader(http.StatusInternalServerError)
+			server.sendError(ErrorSourceView, err)
+			return
 		}
 
-		view := GenerateView(html, vars, handledEvents, server.useTls)
-		_, err := rw.Write([]byte(view))
+		rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, err = rw.Write(buffer.Bytes())
 		if err != nil {
-			server.sendError(err)
+			server.sendError(ErrorSourceView, err)
 		}
 	}
 
-	http.HandleFunc(updatedPath, handler)
-	server.handledPaths = append(server.handledPaths, updatedPath)
-	return nil
+	return server.addRoute(path, http.HandlerFunc(handler))
 }
 
 func (server *Server) AddEventHandler(view string, elementId string, eventType string, handler func(event *ClientEvent)) {
-	eventName := fmt.Sprintf("%s#%s!%s", view, elementId, eventType)
-	if handlers, ok := server.eventHandlers[eventName]; ok {
-		handlers = append(handlers, handler)
-		server.eventHandlers[eventName] = handlers
-	} else {
-		handlers := make([]func(event *ClientEvent), 1)
-		handlers[0] = handler
-		server.eventHandlers[eventName] = handlers
+	err := server.AddEventRoute(EventRoute{
+		View:    view,
+		Id:      elementId,
+		Type:    eventType,
+		Handler: handler,
+	})
+	if err != nil {
+		server.sendError(ErrorSourceHandler, err)
 	}
 }
 
+func (server *Server) AddEventRoute(route EventRoute) error {
+	return server.eventRouter.addRoute(route)
+}
+
+func (server *Server) UseEventMiddleware(middleware ...EventMiddleware) {
+	server.eventRouter.use(middleware...)
+}
+
+func (server *Server) SetEventWorkers(workerCount int, queueSize int) {
+	server.eventRouter.setWorkers(workerCount, queueSize)
+}
+
 func (server *Server) AddVariableSetter(variableName string, setter func(req *http.Request) string) error {
-	reservedNames := []string{"gasp_css", "gasp_js", "server_socket", "now"}
+	reservedNames := []string{"gasp_css", "gasp_js", "server_socket", "now", "fragment", "gasp_authorize"}
 	for _, name := range reservedNames {
 		if strings.HasPrefix(variableName, name) {
 			return fmt.Errorf("variable name '%s' is reserved", variableName)
@@ -271,173 +444,302 @@ func (server *Server) AddVariableSetter(variableName string, setter func(req *ht
 	return nil
 }
 
-func (server *Server) AddRouteGuard(path string, guardFunc func(req *http.Request) (newPath *string)) error {
-	path = strings.TrimSpace(path)
+func (server *Server) getViewConfig(req *http.Request) ViewConfig {
+	config := ViewConfig{
+		ServerSocket:  server.getViewSocket(),
+		HandledEvents: server.eventRouter.handledEvents(),
+		UseTls:        server.useTls,
+		InlineAssets:  server.options.InlineAssets,
+	}
+	if !server.options.DisableCsrfToken {
+		config.CsrfToken = server.GenerateCsrfToken(req)
+	}
+	return config
+}
+
+func (server *Server) getTemplateFuncs(req *http.Request) template.FuncMap {
+	return template.FuncMap{
+		"gasp_css": func() template.HTML {
+			return template.HTML(getStyleHtml(server.getViewConfig(req)))
+		},
+		"gasp_js": func() template.HTML {
+			return template.HTML(getScriptHtml(server.getViewConfig(req)))
+		},
+		"server_socket": func() string {
+			return server.getViewSocket()
+		},
+		"now": formatNow,
+		"fragment": func(name string, data ...any) (template.HTML, error) {
+			return server.renderFragment(name, req, data...)
+		},
+		"var": func(name string) string {
+			if setter, ok := server.varSetters[name]; ok {
+				return setter(req)
+			}
+			return ""
+		},
+	}
+}
+
+func (server *Server) handlePanic(event *ClientEvent, recovered interface{}, stack []byte) {
+	server.sendClientError(ErrorSourceHandler, event.ClientId, newHandlerError(event, recovered, stack))
+
+	if server.options.NotifyClientOnHandlerError && event.ClientId != "" {
+		_ = server.SendEventToClient(event.ClientId, &ServerEvent{
+			Type: "handler_error",
+			Text: fmt.Sprintf("the server failed to process the '%s' event", event.Type),
+			Data: map[string]interface{}{
+				"view": event.View,
+				"id":   event.Id,
+				"type": event.Type,
+			},
+		})
+	}
+}
+
+func (server *Server) sendError(source ErrorSource, err error) {
+	server.sendClientError(source, "", err)
+}
 
-	if path == "" {
-		path = "/"
+func (server *Server) sendClientError(source ErrorSource, clientId string, err error) {
+	if err == nil {
+		return
 	}
 
-	if path[:1] != "/" {
-		path = "/" + path
+	if !server.options.ReportBenignErrors && IsBenignError(err) {
+		return
 	}
 
-	if path == "/gaspws" {
-		return errors.New("path cannot be '/gaspws', which is reserved for the WebSockets channel")
+	gaspErr := &Error{
+		Source:   source,
+		ClientId: clientId,
+		Err:      err,
 	}
 
-	if _, ok := server.guardedPaths[path]; ok {
-		return fmt.Errorf("path '%s' already guarded", path)
+	if server.options.Logger != nil {
+		server.options.Logger.Error("gasp: "+string(source)+" error", "client_id", clientId, "error", err)
 	}
 
-	server.guardedPaths[path] = guardFunc
-	return nil
-}
+	if server.options.OnError != nil {
+		server.options.OnError(gaspErr)
+	}
 
-func (server *Server) sendError(err error) {
 	select {
-	case server.ErrorChan <- err:
+	case server.ErrorChan <- gaspErr:
 	default:
 	}
 }
 
-func (server *Server) validateNewPath(path string) (string, error) {
-	path = strings.TrimSpace(path)
-
-	if path == "" {
-		path = "/"
+func (server *Server) validateNewPath(path string) (*routePattern, error) {
+	pattern, err := parseRoutePattern(path)
+	if err != nil {
+		return nil, err
 	}
 
-	if path[:1] != "/" {
-		path = "/" + path
+	if pattern.path() == websocketsPath {
+		return nil, errors.New("path cannot be '/gaspws', which is reserved for the WebSockets channel")
 	}
 
-	if path == "/gaspws" {
-		return "", errors.New("path cannot be '/gaspws', which is reserved for the WebSockets channel")
+	if strings.HasPrefix(pattern.path(), assetsPath) {
+		return nil, fmt.Errorf("path cannot start with '%s', which is reserved for Gasp's assets", assetsPath)
 	}
 
-	for _, p := range server.handledPaths {
-		if p == path {
-			return "", fmt.Errorf("path '%s' already handled", path)
-		}
+	if server.routes.has(pattern.text) {
+		return nil, fmt.Errorf("path '%s' already handled", pattern.text)
 	}
 
-	return path, nil
+	return pattern, nil
 }
 
 func (server *Server) addDefaultHandler() {
-	http.HandleFunc("/", func(rw http.ResponseWriter, req *http.Request) {
+	pattern, _ := parseRoutePattern("/")
+	_ = server.routes.add(&routeEntry{pattern: pattern, handler: http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
 		_, err := rw.Write([]byte("Gasp Server Online"))
 		if err != nil {
-			server.sendError(err)
+			server.sendError(ErrorSourceView, err)
 		}
-	})
-	server.handledPaths = append(server.handledPaths, "/")
+	})})
 }
 
-func (server *Server) processOutgoingEvents(ws *websocket.Conn, abortChan <-chan bool) {
+func (server *Server) processOutgoingEvents(c *client) {
+	maxBatchSize := server.options.MaxBatchSize
+	if maxBatchSize < 1 {
+		maxBatchSize = defaultMaxBatchSize
+	}
+
 	for {
-		select {
-		case <-abortChan:
+		events, ok := c.queue.pop(maxBatchSize)
+		if !ok {
 			return
-		case outEvt := <-server.eventChan:
-			evtBytes, err := json.Marshal(outEvt)
-			if err != nil {
-				server.sendError(err)
-			}
-			err = ws.WriteMessage(websocket.TextMessage, evtBytes)
-			if err != nil {
-				server.sendError(err)
-			}
 		}
+
+		batched := len(events) > 1
+		if batched {
+			server.queueCounters.batches.Add(1)
+		}
+
+		messageType := websocket.TextMessage
+		var evtBytes []byte
+		var err error
+		switch {
+		case server.options.MessageFormat == MessageFormatBinary:
+			messageType = websocket.BinaryMessage
+			evtBytes, err = encodeBinaryMessage(events, batched)
+		case batched:
+			evtBytes, err = json.Marshal(events)
+		default:
+			evtBytes, err = json.Marshal(events[0])
+		}
+		if err != nil {
+			server.sendClientError(ErrorSourceWebsocket, c.id, err)
+			continue
+		}
+
+		err = c.ws.WriteMessage(messageType, evtBytes)
+		if err != nil {
+			server.sendClientError(ErrorSourceWebsocket, c.id, err)
+		}
+	}
+}
+
+func (server *Server) enqueueEvent(c *client, event *ServerEvent) {
+	if !c.queue.push(event) {
+		server.sendClientError(ErrorSourceWebsocket, c.id, errors.New("disconnecting slow client, its outgoing event queue is full"))
+		_ = c.ws.Close()
 	}
 }
 
-func (server *Server) processIncomingEvents(ws *websocket.Conn) {
+func (server *Server) processIncomingEvents(c *client) {
 	for {
-		_, p, err := ws.ReadMessage()
+		_, p, err := c.ws.ReadMessage()
 		if err != nil {
-			server.sendError(err)
+			server.countReadError(err)
+			server.sendClientError(ErrorSourceWebsocket, c.id, err)
 			return
 		}
+		server.extendReadDeadline(c.ws)
 
 		event := ClientEvent{}
 		err = json.Unmarshal(p, &event)
 		if err != nil {
-			server.sendError(err)
+			server.sendClientError(ErrorSourceDecode, c.id, err)
 			return
 		}
 
-		if server.form != nil {
-			event.Form = server.form
+		if !server.allowEvent(c, &event) {
+			continue
 		}
 
-		if eventHandlers, ok := server.eventHandlers[event.View+"#"+event.Id+"!"+event.Type]; ok {
-			for _, handler := range eventHandlers {
-				handler(&event)
-			}
+		event.ClientId = c.id
+		event.Params = server.viewParams(event.View)
+		event.Principal = GetPrincipal(c.request)
+		event.ClientCertificate = GetClientCertificate(c.request)
+		if session := GetSession(c.request); session != nil {
+			event.Session, _ = server.loadSession(server.signSessionId(session.id))
 		}
 
-		if eventHandlers, ok := server.eventHandlers["*#"+event.Id+"!"+event.Type]; ok {
-			for _, handler := range eventHandlers {
-				handler(&event)
-			}
+		if !server.isAuthorizedEvent(&event) {
+			server.sendClientError(ErrorSourceAuth, c.id, fmt.Errorf("%w: '%s' event from element '%s' in view '%s'", ErrUnauthorized, event.Type, event.Id, event.View))
+			continue
 		}
 
-		if eventHandlers, ok := server.eventHandlers[event.View+"#*!"+event.Type]; ok {
-			for _, handler := range eventHandlers {
-				handler(&event)
-			}
+		if server.form != nil {
+			event.Form = server.form
 		}
 
-		if eventHandlers, ok := server.eventHandlers["*#*!"+event.Type]; ok {
-			for _, handler := range eventHandlers {
-				handler(&event)
-			}
-		}
+		server.recordEvent(c, &event)
+		server.eventRouter.submit(&event)
+	}
+}
+
+func (server *Server) addClient(c *client) {
+	server.clientsMutex.Lock()
+	defer server.clientsMutex.Unlock()
+	server.clients[c.id] = c
+}
+
+func (server *Server) getClients() []*client {
+	server.clientsMutex.RLock()
+	defer server.clientsMutex.RUnlock()
+
+	clients := make([]*client, 0, len(server.clients))
+	for _, c := range server.clients {
+		clients = append(clients, c)
 	}
+	return clients
+}
+
+func (server *Server) removeClient(c *client) {
+	server.clientsMutex.Lock()
+	defer server.clientsMutex.Unlock()
+	delete(server.clients, c.id)
 }
 
 func (server *Server) getWebsocketsHandler(path string) func(rw http.ResponseWriter, req *http.Request) {
-	for _, p := range server.handledPaths {
-		if p == path {
-			return nil
-		}
+	if server.routes.has(path) {
+		return nil
 	}
 
 	var upgrader = websocket.Upgrader{
-		ReadBufferSize:  1024,
-		WriteBufferSize: 1024,
-		CheckOrigin:     func(r *http.Request) bool { return true },
+		ReadBufferSize:    1024,
+		WriteBufferSize:   1024,
+		CheckOrigin:       func(r *http.Request) bool { return true },
+		EnableCompression: server.options.EnableCompression,
 	}
 
 	return func(rw http.ResponseWriter, req *http.Request) {
+		err := server.checkUpgrade(req)
+		if err != nil {
+			http.Error(rw, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			server.sendError(ErrorSourceWebsocket, err)
+			return
+		}
+
 		ws, err := upgrader.Upgrade(rw, req, nil)
 		if err != nil {
-			server.sendError(err)
+			server.sendError(ErrorSourceWebsocket, err)
+			return
+		}
+
+		defer func() {
+			_ = ws.Close()
+		}()
+
+		queue := newEventQueue(server.options.QueueSize, server.options.QueuePolicy, !server.options.DisableCoalescing, &server.queueCounters)
+		c, err := newClient(ws, queue, req)
+		if err != nil {
+			server.sendError(ErrorSourceWebsocket, err)
+			return
 		}
+		c.limiter = newRateLimiter(server.options.RateLimit)
+		server.configureConnection(ws)
+
+		server.addClient(c)
+		defer server.removeClient(c)
+		defer queue.close()
 
-		server.SendEvent(&ServerEvent{
+		server.enqueueEvent(c, &ServerEvent{
 			Type: "ws_info",
 			Text: "client connected",
+			Data: map[string]interface{}{"client_id": c.id},
 		})
 
-		abortChan := make(chan bool)
-		go server.processOutgoingEvents(ws, abortChan)
-		defer func() {
-			abortChan <- true
-		}()
+		go server.processOutgoingEvents(c)
+
+		keepAliveDone := make(chan struct{})
+		defer close(keepAliveDone)
+		go server.keepAlive(c, keepAliveDone)
 
-		server.processIncomingEvents(ws)
+		server.processIncomingEvents(c)
 	}
 }
 
 func (server *Server) addWebsocketsHandler() {
-	path := "/gaspws"
+	path := websocketsPath
 	handler := server.getWebsocketsHandler(path)
 	if handler == nil {
 		return
 	}
-	http.HandleFunc(path, handler)
-	server.handledPaths = append(server.handledPaths, path)
+	pattern, _ := parseRoutePattern(path)
+	_ = server.routes.add(&routeEntry{pattern: pattern, handler: http.HandlerFunc(handler), internal: true})
 }
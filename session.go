@@ -0,0 +1,383 @@
+package gasp
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultSessionCookieName = "gasp_session"
+	defaultSessionMaxAge     = 24 * time.Hour
+)
+
+var (
+	sessionIdRegex = regexp.MustCompile(`^[0-9a-f]{32}$`)
+)
+
+// SessionOptions enables sessions when a Store is set.  Session IDs are kept in
+// a cookie signed with the Secret, which should be set (to at least 32 random
+// bytes) for sessions to survive a restart, since a random one is used otherwise.
+type SessionOptions struct {
+	Store      SessionStore
+	Secret     []byte
+	CookieName string
+	MaxAge     time.Duration
+	SameSite   http.SameSite
+}
+
+type SessionData struct {
+	Values  map[string]string `json:"values"`
+	Expires time.Time         `json:"expires"`
+}
+
+// SessionStore persists sessions by ID.  Load returns nil (and no error) for
+// sessions that don't exist or have expired.
+type SessionStore interface {
+	Load(id string) (*SessionData, error)
+	Save(id string, data *SessionData) error
+	Delete(id string) error
+}
+
+// Session changes are saved to the store immediately, so they're seen by other
+// requests and by events from the same browser.
+type Session struct {
+	id      string
+	mutex   sync.RWMutex
+	values  map[string]string
+	maxAge  time.Duration
+	store   SessionStore
+	onError func(err error)
+}
+
+type sessionKey struct{}
+
+type MemorySessionStore struct {
+	mutex    sync.Mutex
+	sessions map[string]*SessionData
+}
+
+type FileSessionStore struct {
+	mutex     sync.Mutex
+	directory string
+}
+
+func NewMemorySessionStore() *MemorySessionStore {
+	return &MemorySessionStore{sessions: make(map[string]*SessionData)}
+}
+
+func (store *MemorySessionStore) Load(id string) (*SessionData, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	data, ok := store.sessions[id]
+	if !ok {
+		return nil, nil
+	}
+
+	if time.Now().After(data.Expires) {
+		delete(store.sessions, id)
+		return nil, nil
+	}
+
+	return copySessionData(data), nil
+}
+
+func (store *MemorySessionStore) Save(id string, data *SessionData) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.sessions[id] = copySessionData(data)
+	return nil
+}
+
+func (store *MemorySessionStore) Delete(id string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	delete(store.sessions, id)
+	return nil
+}
+
+// NewFileSessionStore keeps each session in a JSON file in the directory, which is
+// created if it doesn't exist.
+func NewFileSessionStore(directory string) (*FileSessionStore, error) {
+	if strings.TrimSpace(directory) == "" {
+		return nil, errors.New("parameter 'directory' cannot be empty/whitespace")
+	}
+
+	err := os.MkdirAll(directory, 0700)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create session directory: %v", err)
+	}
+
+	return &FileSessionStore{directory: directory}, nil
+}
+
+func (store *FileSessionStore) Load(id string) (*SessionData, error) {
+	sessionPath, err := store.sessionPath(id)
+	if err != nil {
+		return nil, err
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	content, err := os.ReadFile(sessionPath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	data := SessionData{}
+	err = json.Unmarshal(content, &data)
+	if err != nil {
+		return nil, err
+	}
+
+	if time.Now().After(data.Expires) {
+		_ = os.Remove(sessionPath)
+		return nil, nil
+	}
+
+	return &data, nil
+}
+
+func (store *FileSessionStore) Save(id string, data *SessionData) error {
+	sessionPath, err := store.sessionPath(id)
+	if err != nil {
+		return err
+	}
+
+	content, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	tempPath := sessionPath + ".tmp"
+	err = os.WriteFile(tempPath, content, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tempPath, sessionPath)
+}
+
+func (store *FileSessionStore) Delete(id string) error {
+	sessionPath, err := store.sessionPath(id)
+	if err != nil {
+		return err
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	err = os.Remove(sessionPath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (store *FileSessionStore) sessionPath(id string) (string, error) {
+	if !sessionIdRegex.MatchString(id) {
+		return "", fmt.Errorf("invalid session ID '%s'", id)
+	}
+	return filepath.Join(store.directory, id+".json"), nil
+}
+
+func copySessionData(data *SessionData) *SessionData {
+	dataCopy := SessionData{
+		Values:  make(map[string]string, len(data.Values)),
+		Expires: data.Expires,
+	}
+	for k, v := range data.Values {
+		dataCopy.Values[k] = v
+	}
+	return &dataCopy
+}
+
+func GetSession(req *http.Request) *Session {
+	session, _ := req.Context().Value(sessionKey{}).(*Session)
+	return session
+}
+
+func (session *Session) Id() string {
+	return session.id
+}
+
+func (session *Session) Get(key string) string {
+	session.mutex.RLock()
+	defer session.mutex.RUnlock()
+	return session.values[key]
+}
+
+func (session *Session) Values() map[string]string {
+	session.mutex.RLock()
+	defer session.mutex.RUnlock()
+
+	values := make(map[string]string, len(session.values))
+	for k, v := range session.values {
+		values[k] = v
+	}
+	return values
+}
+
+func (session *Session) Set(key string, value string) {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	session.values[key] = value
+	session.save()
+}
+
+func (session *Session) Delete(key string) {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	delete(session.values, key)
+	session.save()
+}
+
+// Destroy removes every value and deletes the session from the store.
+func (session *Session) Destroy() {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	session.values = make(map[string]string)
+	err := session.store.Delete(session.id)
+	if err != nil && session.onError != nil {
+		session.onError(err)
+	}
+}
+
+func (session *Session) save() {
+	err := session.store.Save(session.id, &SessionData{
+		Values:  session.values,
+		Expires: time.Now().Add(session.maxAge),
+	})
+	if err != nil && session.onError != nil {
+		session.onError(err)
+	}
+}
+
+func (server *Server) initSessions() error {
+	options := &server.options.Sessions
+	if options.Store == nil {
+		return nil
+	}
+
+	if options.CookieName == "" {
+		options.CookieName = defaultSessionCookieName
+	}
+
+	if options.MaxAge <= 0 {
+		options.MaxAge = defaultSessionMaxAge
+	}
+
+	if options.SameSite == 0 {
+		options.SameSite = http.SameSiteLaxMode
+	}
+
+	if len(options.Secret) == 0 {
+		options.Secret = make([]byte, 32)
+		_, err := rand.Read(options.Secret)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// loadSession returns the session for the signed session ID, or a new session if
+// the ID is missing or its signature is invalid, in which case the cookie for it
+// must be set.
+func (server *Server) loadSession(signedId string) (*Session, bool) {
+	options := server.options.Sessions
+
+	id, ok := server.verifySessionId(signedId)
+	isNew := !ok
+	if isNew {
+		idBytes := make([]byte, 16)
+		_, _ = rand.Read(idBytes)
+		id = hex.EncodeToString(idBytes)
+	}
+
+	session := Session{
+		id:     id,
+		values: make(map[string]string),
+		maxAge: options.MaxAge,
+		store:  options.Store,
+		onError: func(err error) {
+			server.sendError(ErrorSourceSession, err)
+		},
+	}
+
+	if !isNew {
+		data, err := options.Store.Load(id)
+		if err != nil {
+			server.sendError(ErrorSourceSession, err)
+		} else if data != nil && data.Values != nil {
+			session.values = data.Values
+		}
+	}
+
+	return &session, isNew
+}
+
+func (server *Server) signSessionId(id string) string {
+	mac := hmac.New(sha256.New, server.options.Sessions.Secret)
+	mac.Write([]byte(id))
+	return id + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (server *Server) verifySessionId(signedId string) (string, bool) {
+	id, _, ok := strings.Cut(signedId, ".")
+	if !ok || !sessionIdRegex.MatchString(id) {
+		return "", false
+	}
+	return id, hmac.Equal([]byte(signedId), []byte(server.signSessionId(id)))
+}
+
+func (server *Server) handleSessions(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		options := server.options.Sessions
+
+		signedId := ""
+		cookie, err := req.Cookie(options.CookieName)
+		if err == nil {
+			signedId = cookie.Value
+		}
+
+		session, isNew := server.loadSession(signedId)
+		if isNew {
+			http.SetCookie(rw, &http.Cookie{
+				Name:     options.CookieName,
+				Value:    server.signSessionId(session.id),
+				Path:     "/",
+				MaxAge:   int(options.MaxAge.Seconds()),
+				HttpOnly: true,
+				Secure:   server.useTls,
+				SameSite: options.SameSite,
+			})
+		}
+
+		next.ServeHTTP(rw, req.WithContext(context.WithValue(req.Context(), sessionKey{}, session)))
+	})
+}
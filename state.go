@@ -1,5 +1,10 @@
 package gasp
 
+import (
+	"encoding/base64"
+	"encoding/json"
+)
+
 type ControlAttribute struct {
 	Key   string `json:"key"`
 	Value string `json:"value"`
@@ -12,6 +17,10 @@ type ControlState struct {
 	IsEnabled bool   `json:"is_enabled"`
 }
 
+func (state ControlState) controlId() string {
+	return state.Id
+}
+
 type TextboxState struct {
 	ControlState
 }
@@ -54,6 +63,16 @@ type PacketInspectorState struct {
 	CharHeight int    `json:"char_height"`
 	ByteCount  int    `json:"byte_count"`
 	Packet     string `json:"packet"` // base64-encoded packet bytes
+
+	packet []byte
+}
+
+func (state PacketInspectorState) MarshalJSON() ([]byte, error) {
+	type packetInspectorState PacketInspectorState
+	if state.Packet == "" && state.packet != nil {
+		state.Packet = base64.StdEncoding.EncodeToString(state.packet)
+	}
+	return json.Marshal(packetInspectorState(state))
 }
 
 type FormState struct {
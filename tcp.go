@@ -3,21 +3,120 @@ package gasp
 import (
 	"errors"
 	"fmt"
+	"net"
+	"net/url"
+	"os"
 	"regexp"
+	"strconv"
 	"strings"
 )
 
+const (
+	unixSocketPrefix = "unix:"
+)
+
+var (
+	hostnameRegex = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9\-]*[a-zA-Z0-9])?(\.[a-zA-Z0-9]([a-zA-Z0-9\-]*[a-zA-Z0-9])?)*\.?$`)
+)
+
+// ValidateSocket accepts <host>:<port> (with a hostname, an IPv4 address or a
+// bracketed IPv6 address), :<port> to listen on all interfaces, and unix:<path> for
+// Unix domain sockets.
 func ValidateSocket(socket string) error {
 	if strings.TrimSpace(socket) == "" {
 		return errors.New("socket is empty")
 	}
-	regEx, err := regexp.Compile("((([a-zA-Z\\-]+\\.)?([a-zA-Z\\-]+\\.)?([a-zA-Z\\-]+\\.)([a-zA-Z\\-]+))|((?:\\d{1,3}\\.){3}\\d{1,3})|(localhost)):\\d{1,5}")
+
+	if path, ok := strings.CutPrefix(socket, unixSocketPrefix); ok {
+		if strings.TrimSpace(path) == "" {
+			return fmt.Errorf("socket '%s' is invalid, the Unix socket path is empty", socket)
+		}
+		return nil
+	}
+
+	invalidErr := fmt.Errorf("socket '%s' is invalid, should be in format <fqdn>:<port>, <ip_address>:<port>, [<ipv6_address>]:<port>, :<port> or unix:<path>", socket)
+
+	host, port, err := net.SplitHostPort(socket)
 	if err != nil {
-		return fmt.Errorf("failed to compile regex: %v", err)
+		return invalidErr
+	}
+
+	portNumber, err := strconv.Atoi(port)
+	if err != nil || portNumber < 0 || portNumber > 65535 {
+		return invalidErr
 	}
-	match := regEx.MatchString(socket)
-	if !match {
-		return fmt.Errorf("socket '%s' is invalid, should be in format <fqdn>:<port> or <ip_address>:<port>", socket)
+
+	ipHost, _, _ := strings.Cut(host, "%")
+	if host != "" && net.ParseIP(ipHost) == nil && !hostnameRegex.MatchString(host) {
+		return invalidErr
 	}
+
 	return nil
 }
+
+func listen(socket string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(socket, unixSocketPrefix)
+	if !ok {
+		return net.Listen("tcp", socket)
+	}
+
+	// A socket file left by a server that didn't shut down cleanly is removed, but
+	// not one that's still being listened on.
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		conn, err := net.Dial("unix", path)
+		if err == nil {
+			_ = conn.Close()
+		} else {
+			_ = os.Remove(path)
+		}
+	}
+
+	return net.Listen("unix", path)
+}
+
+// getClientSocket returns the address clients connect to for a listener on the
+// socket, with the listener's actual port (for port 0).  The host is left out for
+// sockets that listen on all interfaces, as it depends on how the server is reached,
+// and the whole address is empty for Unix domain sockets, which browsers reach
+// through a proxy.
+func getClientSocket(socket string, addr net.Addr) string {
+	if strings.HasPrefix(socket, unixSocketPrefix) {
+		return ""
+	}
+
+	host, port, err := net.SplitHostPort(socket)
+	if err != nil {
+		if addr == nil {
+			return socket
+		}
+		host, port, err = net.SplitHostPort(addr.String())
+		if err != nil {
+			return addr.String()
+		}
+	}
+
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		port = strconv.Itoa(tcpAddr.Port)
+	}
+
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = ""
+	}
+
+	return net.JoinHostPort(host, port)
+}
+
+func getBaseUri(socket string, clientSocket string, useTls bool) string {
+	scheme := "http"
+	if useTls {
+		scheme = "https"
+	}
+
+	if path, ok := strings.CutPrefix(socket, unixSocketPrefix); ok {
+		return scheme + "+unix://" + url.PathEscape(path) + "/"
+	}
+	if strings.HasPrefix(clientSocket, ":") {
+		clientSocket = "localhost" + clientSocket
+	}
+	return scheme + "://" + clientSocket + "/"
+}
@@ -0,0 +1,121 @@
+package gasp
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	certificateCheckInterval = time.Second
+)
+
+// CertificateReloader serves a certificate from files that are reloaded when they
+// change, for use as a tls.Config's GetCertificate.  If reloading fails, the
+// previous certificate is kept and the error is passed to OnError (if set).
+type CertificateReloader struct {
+	certFile    string
+	keyFile     string
+	mutex       sync.Mutex
+	certificate *tls.Certificate
+	modTime     time.Time
+	checked     time.Time
+
+	OnError func(err error)
+}
+
+func NewCertificateReloader(certFile string, keyFile string) (*CertificateReloader, error) {
+	reloader := CertificateReloader{certFile: certFile, keyFile: keyFile}
+	err := reloader.reload()
+	if err != nil {
+		return nil, err
+	}
+	return &reloader, nil
+}
+
+func (reloader *CertificateReloader) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	reloader.mutex.Lock()
+	defer reloader.mutex.Unlock()
+
+	if time.Since(reloader.checked) >= certificateCheckInterval {
+		reloader.checked = time.Now()
+		if reloader.latestModTime().After(reloader.modTime) {
+			err := reloader.reload()
+			if err != nil && reloader.OnError != nil {
+				reloader.OnError(err)
+			}
+		}
+	}
+
+	return reloader.certificate, nil
+}
+
+func (reloader *CertificateReloader) reload() error {
+	modTime := reloader.latestModTime()
+
+	certificate, err := tls.LoadX509KeyPair(reloader.certFile, reloader.keyFile)
+	if err != nil {
+		return err
+	}
+
+	reloader.certificate = &certificate
+	reloader.modTime = modTime
+	return nil
+}
+
+func (reloader *CertificateReloader) latestModTime() time.Time {
+	latest := time.Time{}
+	for _, file := range []string{reloader.certFile, reloader.keyFile} {
+		info, err := os.Stat(file)
+		if err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest
+}
+
+// StartWithTLSConfig serves TLS with the config, which provides the certificates
+// (Certificates or GetCertificate) and optionally verifies client certificates
+// (ClientAuth and ClientCAs).
+func (server *Server) StartWithTLSConfig(config *tls.Config) error {
+	if config == nil {
+		return errors.New("parameter 'config' cannot be nil")
+	}
+
+	if len(config.Certificates) == 0 && config.GetCertificate == nil && config.GetConfigForClient == nil {
+		return errors.New("TLS config must contain a certificate")
+	}
+
+	server.useTls = true
+	return server.start(func(httpServer *http.Server, listener net.Listener) error {
+		httpServer.TLSConfig = config
+		return httpServer.ServeTLS(listener, "", "")
+	})
+}
+
+// GetClientCertificate returns the client's certificate if it was verified against
+// the server's tls.Config ClientCAs.
+func GetClientCertificate(req *http.Request) *x509.Certificate {
+	if req == nil || req.TLS == nil || len(req.TLS.VerifiedChains) == 0 || len(req.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return req.TLS.VerifiedChains[0][0]
+}
+
+// ClientCertificateAuth authenticates requests with a verified client certificate,
+// using its subject's common name as the principal name and its organizational
+// units as the roles.
+func ClientCertificateAuth() Authenticator {
+	return AuthenticatorFunc(func(req *http.Request) (*Principal, error) {
+		certificate := GetClientCertificate(req)
+		if certificate == nil {
+			return nil, nil
+		}
+		return &Principal{Name: certificate.Subject.CommonName, Roles: certificate.Subject.OrganizationalUnit}, nil
+	})
+}
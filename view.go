@@ -1,66 +1,227 @@
 package gasp
 
 import (
-	"fmt"
+	"encoding/json"
+	"html/template"
 	"regexp"
-	"strconv"
 	"strings"
 	"time"
 	"tonysoft.com/gasp/resources"
 )
 
-func GenerateView(html string, variables map[string]string, handledEvents []string, useTls bool) string {
-	html = insertStyling(html)
-	html = insertScript(html, handledEvents, useTls)
-	html = replaceNowVariable(html)
-	html = replaceVariables(html, variables)
-	return html
+var (
+	nowFormatRegex = regexp.MustCompile(`^now:([\w\d\-/:,_ ])+$`)
+)
+
+type viewSegmentKind int
+
+const (
+	staticSegment viewSegmentKind = iota
+	styleSegment
+	scriptSegment
+	nowSegment
+	variableSegment
+)
+
+type viewSegment struct {
+	kind viewSegmentKind
+	text string
+}
+
+// CompiledView is a view that has been split into static chunks of HTML and the
+// slots for the variables found in it, so that rendering it only requires the
+// slots to be evaluated.
+type CompiledView struct {
+	segments   []viewSegment
+	variables  []string
+	staticSize int
+}
+
+// ViewConfig is used to generate the Gasp styling and script for a view.  Unless
+// InlineAssets is set, they are linked to rather than embedded in the view, which
+// means the view must be served by a Server.
+type ViewConfig struct {
+	ServerSocket  string
+	HandledEvents []string
+	UseTls        bool
+	InlineAssets  bool
+	CsrfToken     string
 }
 
-func insertStyling(html string) string {
-	return strings.ReplaceAll(html, "<!--gasp_css-->", "<style>"+resources.GaspStyle+"</style>")
+type scriptConfig struct {
+	ServerSocket string                `json:"server_socket,omitempty"`
+	UseTls       bool                  `json:"use_tls"`
+	CsrfToken    string                `json:"csrf_token,omitempty"`
+	Handlers     []scriptConfigHandler `json:"handlers"`
 }
 
-func insertScript(html string, handledEvents []string, useTls bool) string {
-	if len(handledEvents) == 0 {
-		return strings.ReplaceAll(html, "<!--gasp_js-->", "<script>"+resources.GaspScript+"</script>")
+type scriptConfigHandler struct {
+	Id      string `json:"id"`
+	Type    string `json:"type"`
+	Pattern string `json:"pattern,omitempty"`
+}
+
+func CompileView(html string) *CompiledView {
+	view := CompiledView{}
+	seenVariables := make(map[string]bool)
+
+	addStatic := func(text string) {
+		if text != "" {
+			view.segments = append(view.segments, viewSegment{kind: staticSegment, text: text})
+			view.staticSize += len(text)
+		}
 	}
 
-	handlers := ""
-	for _, handler := range handledEvents {
-		view := strings.Split(handler, "#")[0]
-		eventType := strings.Split(handler, "!")[1]
-		id := strings.ReplaceAll(strings.ReplaceAll(handler, view+"#", ""), "!"+eventType, "")
-		handlers += fmt.Sprintf("this.addControlEventHandler('%s', '%s');\n\t\t", id, eventType)
+	for {
+		start := strings.Index(html, "<!--")
+		if start < 0 {
+			break
+		}
+
+		end := strings.Index(html[start+4:], "-->")
+		if end < 0 {
+			break
+		}
+		end += start + 4
+
+		name := html[start+4 : end]
+		addStatic(html[:start])
+		html = html[end+3:]
+
+		switch {
+		case name == "gasp_css":
+			view.segments = append(view.segments, viewSegment{kind: styleSegment})
+		case name == "gasp_js":
+			view.segments = append(view.segments, viewSegment{kind: scriptSegment})
+		case name == "now":
+			view.segments = append(view.segments, viewSegment{kind: nowSegment})
+		case nowFormatRegex.MatchString(name):
+			view.segments = append(view.segments, viewSegment{kind: nowSegment, text: strings.TrimPrefix(name, "now:")})
+		default:
+			view.segments = append(view.segments, viewSegment{kind: variableSegment, text: name})
+			if !seenVariables[name] {
+				seenVariables[name] = true
+				view.variables = append(view.variables, name)
+			}
+		}
+	}
+	addStatic(html)
+
+	return &view
+}
+
+func (view *CompiledView) Variables() []string {
+	return view.variables
+}
+
+func (view *CompiledView) Render(variables map[string]string, handledEvents []string, useTls bool) string {
+	return view.RenderWithConfig(variables, ViewConfig{
+		ServerSocket:  variables["server_socket"],
+		HandledEvents: handledEvents,
+		UseTls:        useTls,
+		InlineAssets:  true,
+	})
+}
+
+func (view *CompiledView) RenderWithConfig(variables map[string]string, config ViewConfig) string {
+	builder := strings.Builder{}
+	builder.Grow(view.staticSize)
+
+	for _, segment := range view.segments {
+		switch segment.kind {
+		case staticSegment:
+			builder.WriteString(segment.text)
+		case styleSegment:
+			builder.WriteString(getStyleHtml(config))
+		case scriptSegment:
+			builder.WriteString(getScriptHtml(config))
+		case nowSegment:
+			builder.WriteString(formatNow(segment.text))
+		case variableSegment:
+			if value, ok := variables[segment.text]; ok {
+				builder.WriteString(value)
+			} else {
+				builder.WriteString("<!--" + segment.text + "-->")
+			}
+		}
 	}
 
-	script := strings.ReplaceAll(resources.GaspScript, "/*event_handlers*/", handlers)
-	script = strings.ReplaceAll(script, "/*tls_override*/", "useTls = "+strconv.FormatBool(useTls)+";")
-	return strings.ReplaceAll(html, "<!--gasp_js-->", "<script>"+script+"</script>")
+	return builder.String()
+}
+
+func GenerateView(html string, variables map[string]string, handledEvents []string, useTls bool) string {
+	return CompileView(html).Render(variables, handledEvents, useTls)
+}
+
+func GenerateViewWithConfig(html string, variables map[string]string, config ViewConfig) string {
+	return CompileView(html).RenderWithConfig(variables, config)
 }
 
-func replaceVariables(html string, variables map[string]string) string {
-	if variables == nil {
-		return html
+func getStyleHtml(config ViewConfig) string {
+	if config.InlineAssets {
+		return "<style>" + resources.GaspStyle + "</style>"
 	}
-	for k, v := range variables {
-		html = strings.ReplaceAll(html, "<!--"+k+"-->", v)
+	return "<link rel=\"stylesheet\" href=\"" + styleAsset.path + "\">"
+}
+
+func getScriptHtml(config ViewConfig) string {
+	scriptConfig := scriptConfig{
+		ServerSocket: config.ServerSocket,
+		UseTls:       config.UseTls,
+		CsrfToken:    config.CsrfToken,
+		Handlers:     make([]scriptConfigHandler, 0, len(config.HandledEvents)),
+	}
+
+	for _, handler := range config.HandledEvents {
+		_, idAndType, _ := strings.Cut(handler, "#")
+		separator := strings.LastIndex(idAndType, "!")
+		if separator < 0 {
+			continue
+		}
+
+		scriptHandler := scriptConfigHandler{Id: idAndType[:separator], Type: idAndType[separator+1:]}
+		pattern, err := newEventPattern(scriptHandler.Id)
+		if err != nil {
+			continue
+		}
+
+		switch {
+		case pattern.regex != nil:
+			scriptHandler.Id = ""
+			scriptHandler.Pattern = pattern.regex.String()
+		case !pattern.isLiteral():
+			scriptHandler.Id = "*"
+		}
+		scriptConfig.Handlers = append(scriptConfig.Handlers, scriptHandler)
+	}
+
+	configJson, err := json.Marshal(scriptConfig)
+	if err != nil {
+		configJson = []byte("{}")
+	}
+
+	html := "<script type=\"application/json\" id=\"gasp-config\">" + string(configJson) + "</script>"
+	if config.InlineAssets {
+		return html + "<script>" + resources.GaspScript + "</script>"
+	}
+	return html + "<script src=\"" + scriptAsset.path + "\"></script>"
+}
+
+func TemplateFuncs() template.FuncMap {
+	return template.FuncMap{
+		"gasp_css":      func() template.HTML { return "" },
+		"gasp_js":       func() template.HTML { return "" },
+		"server_socket": func() string { return "" },
+		"now":           formatNow,
+		"fragment":      func(name string, data ...any) template.HTML { return "" },
+		"var":           func(name string) string { return "" },
 	}
-	return html
 }
 
-func replaceNowVariable(html string) string {
+func formatNow(format ...string) string {
 	now := time.Now().UTC()
-	nowRegex := regexp.MustCompile(`<!--now:([\w\d\-/:,_ ])+-->`)
-	for {
-		nowPlaceholder := nowRegex.FindString(html)
-		if nowPlaceholder != "" {
-			format := strings.ReplaceAll(nowPlaceholder, "<!--now:", "")
-			format = strings.ReplaceAll(format, "-->", "")
-			html = strings.ReplaceAll(html, nowPlaceholder, now.Format(format))
-		} else {
-			html = strings.ReplaceAll(html, "<!--now-->", now.String())
-			return html
-		}
+	if len(format) > 0 && format[0] != "" {
+		return now.Format(format[0])
 	}
+	return now.String()
 }
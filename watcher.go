@@ -0,0 +1,110 @@
+package gasp
+
+import (
+	"io/fs"
+	"sync"
+	"time"
+)
+
+const (
+	defaultWatchInterval = 500 * time.Millisecond
+)
+
+// fileWatcher polls files for changes to their size or modification time, which
+// works with any fs.FS rather than only the directories of the local file system.
+type fileWatcher struct {
+	mutex    sync.Mutex
+	interval time.Duration
+	files    []*watchedFile
+	done     chan struct{}
+}
+
+type watchedFile struct {
+	fsys     fs.FS
+	name     string
+	modTime  time.Time
+	size     int64
+	onChange func()
+}
+
+func newFileWatcher(interval time.Duration) *fileWatcher {
+	if interval <= 0 {
+		interval = defaultWatchInterval
+	}
+	return &fileWatcher{interval: interval}
+}
+
+func (watcher *fileWatcher) watch(fsys fs.FS, name string, onChange func()) {
+	file := watchedFile{
+		fsys:     fsys,
+		name:     name,
+		onChange: onChange,
+	}
+
+	info, err := fs.Stat(fsys, name)
+	if err == nil {
+		file.modTime = info.ModTime()
+		file.size = info.Size()
+	}
+
+	watcher.mutex.Lock()
+	defer watcher.mutex.Unlock()
+	watcher.files = append(watcher.files, &file)
+}
+
+func (watcher *fileWatcher) start() {
+	watcher.mutex.Lock()
+	defer watcher.mutex.Unlock()
+
+	if watcher.done != nil {
+		return
+	}
+
+	done := make(chan struct{})
+	watcher.done = done
+
+	go func() {
+		ticker := time.NewTicker(watcher.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				watcher.poll()
+			}
+		}
+	}()
+}
+
+func (watcher *fileWatcher) stop() {
+	watcher.mutex.Lock()
+	defer watcher.mutex.Unlock()
+
+	if watcher.done != nil {
+		close(watcher.done)
+		watcher.done = nil
+	}
+}
+
+func (watcher *fileWatcher) poll() {
+	watcher.mutex.Lock()
+	files := watcher.files
+	watcher.mutex.Unlock()
+
+	for _, file := range files {
+		info, err := fs.Stat(file.fsys, file.name)
+		if err != nil {
+			continue
+		}
+
+		if info.ModTime().Equal(file.modTime) && info.Size() == file.size {
+			continue
+		}
+
+		file.modTime = info.ModTime()
+		file.size = info.Size()
+		file.onChange()
+	}
+}